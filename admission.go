@@ -0,0 +1,84 @@
+package funnel
+
+import (
+	"context"
+	"sync"
+)
+
+// Admission is the room a request was admitted w/. When the request never
+// reaches the resource, such as when it fails before it is sent, the room
+// can be refunded so that others can use it
+type Admission struct {
+	// limiter is the limiter the room was taken in
+	limiter *RateLimiter
+
+	// tokens is the amount of requests the room was taken for
+	tokens int
+
+	// at is the time (in ms) the room was taken at
+	at int64
+
+	// id identifies the entries that were taken, when the strategy tracks
+	// them individually
+	id string
+
+	// mutex guards the refund
+	mutex sync.Mutex
+
+	// settled is whether the store answered a refund, after which the room
+	// can't be given back again
+	settled bool
+}
+
+// Admit waits for room for the request in the limiter, like EnterContext,
+// and returns the room it was admitted w/
+func (r *RateLimiter) Admit(ctx context.Context) (*Admission, error) {
+	return r.admitN(ctx, 1)
+}
+
+// AdmitN is like Admit, for a request that costs n units of the max requests
+func (r *RateLimiter) AdmitN(ctx context.Context, n int) (*Admission, error) {
+	return r.admitN(ctx, n)
+}
+
+// TryAdmit makes a single attempt to admit the request w/out blocking, like
+// TryEnter. The admission is nil when the request was not admitted
+func (r *RateLimiter) TryAdmit() (*Admission, error) {
+	admission, _, err := r.tryAdmitN(1)
+	return admission, err
+}
+
+// TryAdmitN is like TryAdmit, for a request that costs n units of the max
+// requests
+func (r *RateLimiter) TryAdmitN(n int) (*Admission, error) {
+	admission, _, err := r.tryAdmitN(n)
+	return admission, err
+}
+
+// newAdmission returns the admission for the room the result took for n
+// requests at the given time. Room taken under the failure policy was never
+// counted by the store, so there is nothing to give back
+func (r *RateLimiter) newAdmission(result TakeResult, n int, at int64) *Admission {
+	return &Admission{limiter: r, tokens: n, at: at, id: result.ID, settled: result.Degraded}
+}
+
+// Refund gives the room back to the limiter in a single step, and reports
+// whether it was given back. Once the window the room was taken in has
+// rolled over, the room is already free and Refund does nothing. Refunding
+// more than once does nothing either, unless the store failed.
+//
+// The paced slots of the LeakyBucket strategy can't be refunded
+func (a *Admission) Refund() (bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.settled {
+		return false, nil
+	}
+
+	refunded, err := a.limiter.refund(a.at, a.id, a.tokens)
+	if err != nil {
+		return false, err
+	}
+	a.settled = true
+	return refunded, nil
+}
@@ -0,0 +1,181 @@
+package funnel
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+// AdmissionTest refunds the room of admitted requests on redis, through its
+// own pool, and on a MemoryStore
+type AdmissionTest struct{}
+
+var _ = Suite(&AdmissionTest{})
+
+// refundStrategies are the strategies whose room can be refunded
+var refundStrategies = []Strategy{FixedWindow, SlidingLog, SlidingWindowCounter, GCRA}
+
+// assertRefund fills the 5 requests of the limiter, and checks that a
+// refund frees the room of a request once
+func assertRefund(c *C, rateLimiter *RateLimiter) {
+	admission, err := rateLimiter.Admit(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(admission, NotNil)
+
+	others, err := rateLimiter.TryAdmitN(4)
+	c.Assert(err, IsNil)
+	c.Assert(others, NotNil)
+	assertFull(c, rateLimiter)
+
+	refunded, err := admission.Refund()
+	c.Assert(err, IsNil)
+	c.Assert(refunded, Equals, true, Commentf("%s", rateLimiter.strategy))
+
+	again, err := rateLimiter.TryAdmit()
+	c.Assert(err, IsNil)
+	c.Assert(again, NotNil)
+
+	// The room was already given back
+	refunded, err = admission.Refund()
+	c.Assert(err, IsNil)
+	c.Assert(refunded, Equals, false)
+	assertFull(c, rateLimiter)
+}
+
+// assertRefundAfterRollover takes a request, waits for the window of the
+// limiter to roll over, and checks that refunding it doesn't free up room
+// taken in the new window
+func assertRefundAfterRollover(c *C, rateLimiter *RateLimiter) {
+	admission, err := rateLimiter.TryAdmit()
+	c.Assert(err, IsNil)
+	c.Assert(admission, NotNil)
+
+	time.Sleep(250 * time.Millisecond)
+	for {
+		other, err := rateLimiter.TryAdmit()
+		c.Assert(err, IsNil)
+		if other == nil {
+			break
+		}
+	}
+
+	refunded, err := admission.Refund()
+	c.Assert(err, IsNil)
+	c.Assert(refunded, Equals, false, Commentf("%s", rateLimiter.strategy))
+	assertFull(c, rateLimiter)
+}
+
+// assertFull checks that the limiter has no room left
+func assertFull(c *C, rateLimiter *RateLimiter) {
+	admission, err := rateLimiter.TryAdmit()
+	c.Assert(err, IsNil)
+	c.Assert(admission, IsNil)
+}
+
+//---------
+// Test Refund
+//---------
+
+// TestRefundOnRedis tests refunding the room of each strategy on redis
+func (a *AdmissionTest) TestRefundOnRedis(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	for _, strategy := range refundStrategies {
+		rateLimiter, err := New("refundToken", 5, time.Second, WithStore(NewRedisStore(pool)), WithStrategy(strategy))
+		c.Assert(err, IsNil)
+		clearStatusLimiter(c, pool, rateLimiter.limit())
+		assertRefund(c, rateLimiter)
+	}
+}
+
+// TestRefundInMemory tests refunding the room of each strategy on a
+// MemoryStore
+func (a *AdmissionTest) TestRefundInMemory(c *C) {
+	for _, strategy := range refundStrategies {
+		rateLimiter, err := New("refundToken", 5, time.Second, WithStore(NewMemoryStore()), WithStrategy(strategy))
+		c.Assert(err, IsNil)
+		assertRefund(c, rateLimiter)
+	}
+}
+
+// TestRefundAfterRollover tests that a refund after the window rolled over
+// does nothing, on redis and on a MemoryStore
+func (a *AdmissionTest) TestRefundAfterRollover(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	for _, strategy := range refundStrategies {
+		rateLimiter, err := New("refundRolloverToken", 5, 200*time.Millisecond, WithStore(NewRedisStore(pool)), WithStrategy(strategy))
+		c.Assert(err, IsNil)
+		clearStatusLimiter(c, pool, rateLimiter.limit())
+		assertRefundAfterRollover(c, rateLimiter)
+
+		rateLimiter, err = New("refundRolloverToken", 5, 200*time.Millisecond, WithStore(NewMemoryStore()), WithStrategy(strategy))
+		c.Assert(err, IsNil)
+		assertRefundAfterRollover(c, rateLimiter)
+	}
+}
+
+// TestRefundOfLeakyBucket tests that the paced slots of a LeakyBucket aren't
+// refunded
+func (a *AdmissionTest) TestRefundOfLeakyBucket(c *C) {
+	rateLimiter, err := New("refundToken", 50, time.Second, WithStore(NewMemoryStore()), WithStrategy(LeakyBucket))
+	c.Assert(err, IsNil)
+
+	admission, err := rateLimiter.Admit(context.Background())
+	c.Assert(err, IsNil)
+	refunded, err := admission.Refund()
+	c.Assert(err, IsNil)
+	c.Assert(refunded, Equals, false)
+}
+
+// TestRefundOfCompositeLimiter tests that a refund gives the room back in
+// every rule, on redis and on a MemoryStore
+func (a *AdmissionTest) TestRefundOfCompositeLimiter(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	rules := []Rule{
+		{MaxRequests: 5, Interval: time.Second},
+		{MaxRequests: 5, Interval: time.Minute},
+	}
+	for _, store := range []Store{NewRedisStore(pool), NewMemoryStore()} {
+		rateLimiter, err := NewCompositeLimiter("refundCompositeToken", rules, WithStore(store))
+		c.Assert(err, IsNil)
+		clearStatusLimiter(c, pool, rateLimiter.limit())
+		assertRefund(c, rateLimiter)
+	}
+}
+
+// TestRefundOnQuorumStore tests that a quorum of the nodes give the room
+// back, even w/ a node down
+func (a *AdmissionTest) TestRefundOnQuorumStore(c *C) {
+	rateLimiter := newQuorumLimiter(c, "refundQuorumToken", 5, newTestPool(2), newTestPool(3), newDownPool())
+	assertRefund(c, rateLimiter)
+}
+
+// TestRefundAfterFailOpen tests that room the store never counted isn't
+// given back
+func (a *AdmissionTest) TestRefundAfterFailOpen(c *C) {
+	rateLimiter, store := newFlakyLimiter(c, 5, WithFailurePolicy(FailOpen))
+
+	admission, err := rateLimiter.TryAdmit()
+	c.Assert(err, IsNil)
+	c.Assert(admission, NotNil)
+
+	atomic.StoreInt32(&store.down, 0)
+	refunded, err := admission.Refund()
+	c.Assert(err, IsNil)
+	c.Assert(refunded, Equals, false)
+
+	// Room the store counted is given back, even when the limiter was
+	// degraded by another request in the meantime
+	rateLimiter.setMode(ModeDegraded, rateLimiter.now())
+	admission = rateLimiter.newAdmission(TakeResult{Admitted: true}, 1, rateLimiter.now())
+	c.Assert(admission.settled, Equals, false)
+}
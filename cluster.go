@@ -0,0 +1,238 @@
+package funnel
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// clusterSlots is the amount of hash slots in a redis cluster
+	clusterSlots = 16384
+
+	// clusterRedirects is the max amount of MOVED or ASK redirects followed
+	// for a single command
+	clusterRedirects = 5
+)
+
+// ClusterPool vends connections to the nodes of a redis cluster. Limiters
+// created w/ a ClusterPool send each command to the node serving the hash
+// slot of its keys, and follow the redirects of the cluster when slots move
+type ClusterPool struct {
+	// seeds are the addresses of the nodes the cluster is discovered from
+	seeds []string
+
+	// dialOptions are used for every connection to a node
+	dialOptions []redis.DialOption
+
+	// mutex guards the pools and slots
+	mutex sync.RWMutex
+
+	// pools holds a connection pool for each node by its address
+	pools map[string]*redis.Pool
+
+	// slots holds the address of the node serving each hash slot
+	slots [clusterSlots]string
+}
+
+// NewClusterPool is a factory method for creating a pool for the redis
+// cluster that the seed nodes belong to
+func NewClusterPool(seeds []string, opts ...redis.DialOption) (*ClusterPool, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("Unable to create the cluster pool. At least one seed address is required")
+	}
+
+	pool := &ClusterPool{
+		seeds:       seeds,
+		dialOptions: opts,
+		pools:       make(map[string]*redis.Pool),
+	}
+	if err := pool.refresh(); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// Get returns a connection to the first seed node. Commands sent on it must
+// not touch keys served by other nodes, use GetForKey for those
+func (p *ClusterPool) Get() redis.Conn {
+	return p.nodePool(p.seeds[0]).Get()
+}
+
+// GetForKey returns a connection to the node serving the hash slot of key
+func (p *ClusterPool) GetForKey(key string) redis.Conn {
+	p.mutex.RLock()
+	addr := p.slots[keySlot(key)]
+	p.mutex.RUnlock()
+
+	if addr == "" {
+		addr = p.seeds[0]
+	}
+	return p.nodePool(addr).Get()
+}
+
+// Close closes the pools of every node
+func (p *ClusterPool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var err error
+	for addr, pool := range p.pools {
+		if closeErr := pool.Close(); closeErr != nil {
+			err = closeErr
+		}
+		delete(p.pools, addr)
+	}
+	return err
+}
+
+// refresh loads the node serving each hash slot from the first seed that
+// answers CLUSTER SLOTS
+func (p *ClusterPool) refresh() error {
+	var err error
+	for _, seed := range p.seeds {
+		var slots []interface{}
+		conn := p.nodePool(seed).Get()
+		slots, err = redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			continue
+		}
+
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		for _, entry := range slots {
+			// Each entry is {start, end, {ip, port, id}, replicas...}
+			fields, err := redis.Values(entry, nil)
+			if err != nil || len(fields) < 3 {
+				return errors.New("Unable to read the cluster slots. Unexpected reply to CLUSTER SLOTS")
+			}
+			start, _ := redis.Int(fields[0], nil)
+			end, _ := redis.Int(fields[1], nil)
+			master, _ := redis.Values(fields[2], nil)
+			if len(master) < 2 {
+				return errors.New("Unable to read the cluster slots. Unexpected reply to CLUSTER SLOTS")
+			}
+			ip, _ := redis.String(master[0], nil)
+			port, _ := redis.Int(master[1], nil)
+
+			addr := ip + ":" + strconv.Itoa(port)
+			for slot := start; slot <= end && slot < clusterSlots; slot++ {
+				p.slots[slot] = addr
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+// nodePool returns the connection pool for the node at addr, creating it
+// when there is none
+func (p *ClusterPool) nodePool(addr string) *redis.Pool {
+	p.mutex.RLock()
+	pool, ok := p.pools[addr]
+	p.mutex.RUnlock()
+	if ok {
+		return pool
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if pool, ok := p.pools[addr]; ok {
+		return pool
+	}
+	pool = &redis.Pool{
+		MaxIdle: 3,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, p.dialOptions...)
+		},
+	}
+	p.pools[addr] = pool
+	return pool
+}
+
+// setSlot records the node now serving a hash slot
+func (p *ClusterPool) setSlot(slot int, addr string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if slot >= 0 && slot < clusterSlots {
+		p.slots[slot] = addr
+	}
+}
+
+// run runs f on a connection to the node serving key. When the cluster
+// answers w/ a MOVED or ASK redirect, f is run again on the node it points to
+func (p *ClusterPool) run(key string, f func(redis.Conn) (interface{}, error)) (interface{}, error) {
+	conn := p.GetForKey(key)
+	asking := false
+	for i := 0; ; i++ {
+		var reply interface{}
+		var err error
+		if asking {
+			_, err = conn.Do("ASKING")
+		}
+		if err == nil {
+			reply, err = f(conn)
+		}
+		conn.Close()
+
+		// A redirect looks like "MOVED 3999 127.0.0.1:6381"
+		redirect, ok := err.(redis.Error)
+		if !ok || i == clusterRedirects {
+			return reply, err
+		}
+		fields := strings.Fields(string(redirect))
+		if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+			return reply, err
+		}
+
+		asking = fields[0] == "ASK"
+		if !asking {
+			slot, _ := strconv.Atoi(fields[1])
+			p.setSlot(slot, fields[2])
+		}
+		conn = p.nodePool(fields[2]).Get()
+	}
+}
+
+/**
+ * Hash Slots
+ */
+
+// keySlot returns the cluster hash slot of key. When the key has a hash tag,
+// such as "{token}_leases", only the tag is hashed, so that every key w/ the
+// same tag lands on the same slot
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// hashTag wraps the token in braces, so that every key derived from it is
+// served by the same cluster node
+func hashTag(token string) string {
+	return "{" + token + "}"
+}
@@ -0,0 +1,149 @@
+package funnel
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+import (
+	"github.com/garyburd/redigo/redis"
+	. "gopkg.in/check.v1"
+)
+
+// The cluster tests run against a local redis cluster, such as one created
+// w/ `redis-cli --cluster create`, when its seed addresses are given
+var cluster = flag.String("cluster", "", "Comma separated seed addresses of a redis cluster to test against")
+
+type ClusterTest struct{}
+
+var _ = Suite(&ClusterTest{})
+
+// newTestClusterPool creates a pool for the cluster under test, skipping
+// the test when there is none
+func newTestClusterPool(c *C) *ClusterPool {
+	if *cluster == "" {
+		c.Skip("-cluster not provided")
+	}
+
+	pool, err := NewClusterPool(strings.Split(*cluster, ","))
+	c.Assert(err, IsNil)
+	return pool
+}
+
+// newClusterLimiter creates a cleared limiter on the cluster
+func newClusterLimiter(c *C, pool *ClusterPool, token string, max int) *RateLimiter {
+	limiterInfo := &RateLimitInfo{
+		Token:        token,
+		MaxRequests:  max,
+		TimeInterval: 1000,
+	}
+
+	rateLimiter, err := NewLimiterWithPool(pool, limiterInfo)
+	c.Assert(err, IsNil)
+
+	limit := rateLimiter.limit()
+	_, err = runOnKey(pool, limit.rateLimiterToken(), func(conn redis.Conn) (interface{}, error) {
+		return conn.Do("DEL", limit.rateLimiterToken(), limit.reservationsToken())
+	})
+	c.Assert(err, IsNil)
+	return rateLimiter
+}
+
+// exerciseClusterLimiter fills the current window of the limiter and
+// reserves room in the next one, which touches both of its keys
+func exerciseClusterLimiter(c *C, rateLimiter *RateLimiter) {
+	admitted, err := rateLimiter.TryEnterN(2)
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+
+	admitted, err = rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+
+	reservation, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(reservation.OK(), Equals, true)
+	c.Assert(reservation.Delay() > 0, Equals, true)
+}
+
+//---------
+// Test Hash Slots
+//---------
+
+// TestKeySlot tests the hash slots against the ones given by redis
+func (s *ClusterTest) TestKeySlot(c *C) {
+	c.Assert(keySlot("123456789"), Equals, 12739)
+	c.Assert(keySlot("foo"), Equals, 12182)
+	c.Assert(keySlot("{user1000}.following"), Equals, keySlot("{user1000}.followers"))
+	c.Assert(keySlot("{user1000}.following"), Equals, keySlot("user1000"))
+
+	// Only the first tag counts, and an empty one is no tag at all
+	c.Assert(keySlot("foo{{bar}}zap"), Equals, keySlot("{bar"))
+	c.Assert(keySlot("foo{}{bar}"), Equals, int(crc16("foo{}{bar}")%clusterSlots))
+}
+
+// TestLimiterKeysShareSlot tests that every key of a limiter lands on the
+// same hash slot
+func (s *ClusterTest) TestLimiterKeysShareSlot(c *C) {
+	limit := &Limit{Token: "slotToken_rateLimiterToken"}
+	slot := keySlot(limit.rateLimiterToken())
+	c.Assert(keySlot(limit.reservationsToken()), Equals, slot)
+	c.Assert(keySlot(limit.slidingLogToken()), Equals, slot)
+	c.Assert(keySlot(limit.slidingCounterToken()), Equals, slot)
+	c.Assert(keySlot(limit.gcraToken()), Equals, slot)
+	c.Assert(keySlot(limit.leakyBucketToken()), Equals, slot)
+}
+
+// TestClusterPoolWithoutSeeds tests that a cluster pool needs a seed
+func (s *ClusterTest) TestClusterPoolWithoutSeeds(c *C) {
+	_, err := NewClusterPool(nil)
+	c.Assert(err, NotNil)
+}
+
+//---------
+// Test A Live Cluster
+//---------
+
+// TestClusterLimiters tests that limiters spread across the slots of the
+// cluster each work on their own node
+func (s *ClusterTest) TestClusterLimiters(c *C) {
+	pool := newTestClusterPool(c)
+	defer pool.Close()
+
+	for i := 0; i < 20; i++ {
+		exerciseClusterLimiter(c, newClusterLimiter(c, pool, fmt.Sprintf("clusterToken%d", i), 2))
+	}
+
+	lease, err := mustConcurrencyLimiter(c, pool).TryAcquire()
+	c.Assert(err, IsNil)
+	c.Assert(lease, NotNil)
+	c.Assert(lease.Release(), IsNil)
+}
+
+// TestClusterRedirects tests that limiters follow the redirects of the
+// cluster when the slots they know of are out of date
+func (s *ClusterTest) TestClusterRedirects(c *C) {
+	pool := newTestClusterPool(c)
+	defer pool.Close()
+
+	// Pretend every slot moved to the first seed
+	for slot := range pool.slots {
+		pool.slots[slot] = pool.seeds[0]
+	}
+
+	for i := 0; i < 20; i++ {
+		exerciseClusterLimiter(c, newClusterLimiter(c, pool, fmt.Sprintf("redirectToken%d", i), 2))
+	}
+}
+
+// mustConcurrencyLimiter creates a concurrency limiter on the cluster
+func mustConcurrencyLimiter(c *C, pool *ClusterPool) *ConcurrencyLimiter {
+	limiter, err := NewConcurrencyLimiterWithPool(pool, &ConcurrencyInfo{Token: "clusterToken", MaxConcurrent: 1})
+	c.Assert(err, IsNil)
+	_, err = runOnKey(pool, limiter.leasesToken(), func(conn redis.Conn) (interface{}, error) {
+		return conn.Do("DEL", limiter.leasesToken())
+	})
+	c.Assert(err, IsNil)
+	return limiter
+}
@@ -0,0 +1,95 @@
+package funnel
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Rule is one of the limits of a composite limiter, such as 600 requests per
+// minute
+type Rule struct {
+	// MaxRequests is the maximum amount of requests for the Interval
+	MaxRequests int
+
+	// Interval is the rolling time interval the max requests can take place
+	// inside of. It is counted to the ms
+	Interval time.Duration
+}
+
+// NewCompositeLimiter is a factory method for creating a rate limiter that
+// stacks several rules, such as 10 requests per second, 600 per minute and
+// 100k per day. A request is only admitted when every rule has room for it,
+// and then takes room in all of them at once, so a request turned down by
+// one rule costs the others nothing.
+//
+// Each rule is counted like the SlidingWindowCounter strategy, so the limiter
+// doesn't support reservations. Its state is kept in redis, through the
+// meshRedis pool, unless a store is given w/ WithStore
+func NewCompositeLimiter(token string, rules []Rule, opts ...Option) (*RateLimiter, error) {
+	if token == "" {
+		return nil, errors.New("Unable to create the composite limiter. A token is required")
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("Unable to create the composite limiter. At least one rule is required")
+	}
+
+	// The tightest rule stands in for the limiter where a single limit is
+	// needed, such as the most requests that can ever be admitted at once
+	tightest := rules[0]
+	intervals := make(map[int64]bool)
+	for _, rule := range rules {
+		if rule.MaxRequests <= 0 {
+			return nil, errors.New("Unable to create the composite limiter. The max requests of every rule must be positive")
+		}
+		if rule.Interval < time.Millisecond {
+			return nil, errors.New("Unable to create the composite limiter. The interval of every rule must be at least 1ms")
+		}
+		if intervals[rule.interval()] {
+			return nil, fmt.Errorf("Unable to create the composite limiter. There is more than one rule for an interval of %s", rule.Interval)
+		}
+		intervals[rule.interval()] = true
+
+		if rule.MaxRequests < tightest.MaxRequests {
+			tightest.MaxRequests = rule.MaxRequests
+		}
+		if rule.Interval < tightest.Interval {
+			tightest.Interval = rule.Interval
+		}
+	}
+
+	limitInfo := &RateLimitInfo{
+		Token:        token,
+		MaxRequests:  tightest.MaxRequests,
+		TimeInterval: tightest.interval(),
+		Strategy:     SlidingWindowCounter,
+	}
+	limiter, err := newLimiter(nil, limitInfo, opts)
+	if err != nil {
+		return nil, err
+	}
+	limiter.rules = append([]Rule(nil), rules...)
+
+	if err := limiter.setDefaultStore(); err != nil {
+		return nil, err
+	}
+
+	if err := limiter.setup(limitInfo); err != nil {
+		return nil, err
+	}
+	return limiter, nil
+}
+
+// interval returns the interval of the rule in ms
+func (r Rule) interval() int64 {
+	return int64(r.Interval / time.Millisecond)
+}
+
+// compositeArgs returns the keys and arguments of the compositeScript
+func (l *Limit) compositeArgs(n int, now int64) []interface{} {
+	args := []interface{}{l.compositeToken(), n, now}
+	for _, rule := range l.Rules {
+		args = append(args, rule.MaxRequests, rule.interval())
+	}
+	return args
+}
@@ -0,0 +1,129 @@
+package funnel
+
+import (
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/garyburd/redigo/redis"
+	. "gopkg.in/check.v1"
+)
+
+// CompositeLimiterTest runs the rules against redis, through its own pool,
+// and against a MemoryStore
+type CompositeLimiterTest struct{}
+
+var _ = Suite(&CompositeLimiterTest{})
+
+// compositeRules are 2 requests per 200ms and 3 per minute
+var compositeRules = []Rule{
+	{MaxRequests: 2, Interval: 200 * time.Millisecond},
+	{MaxRequests: 3, Interval: time.Minute},
+}
+
+// assertCompositeRules fills the short rule, then the long one, and checks
+// that requests turned down by the long rule cost the short one nothing.
+// count returns the requests counted by the short rule
+func assertCompositeRules(c *C, rateLimiter *RateLimiter, count func() int) {
+	assertAdmits(c, rateLimiter, true)
+	assertAdmits(c, rateLimiter, true)
+
+	// The short rule is full
+	admitted, reset, err := rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(reset <= 400*time.Millisecond, Equals, true)
+
+	// Once the short rule forgets them, only the long one has room left
+	time.Sleep(450 * time.Millisecond)
+	assertAdmits(c, rateLimiter, true)
+
+	admitted, reset, err = rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(reset > time.Second, Equals, true)
+	c.Assert(count(), Equals, 1)
+}
+
+//---------
+// Test Composite Limiter
+//---------
+
+// TestCompositeLimiterOnRedis tests the rules on redis
+func (t *CompositeLimiterTest) TestCompositeLimiterOnRedis(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	rateLimiter, err := NewCompositeLimiter("compositeToken", compositeRules, WithStore(NewRedisStore(pool)))
+	c.Assert(err, IsNil)
+
+	conn := pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("DEL", rateLimiter.limit().compositeToken())
+	c.Assert(err, IsNil)
+
+	assertCompositeRules(c, rateLimiter, func() int {
+		counters, err := redis.IntMap(conn.Do("HGETALL", rateLimiter.limit().compositeToken()))
+		c.Assert(err, IsNil)
+
+		count := 0
+		for field, counter := range counters {
+			if strings.HasPrefix(field, "200:") {
+				count += counter
+			}
+		}
+		return count
+	})
+}
+
+// TestCompositeLimiterInMemory tests the rules on a MemoryStore
+func (t *CompositeLimiterTest) TestCompositeLimiterInMemory(c *C) {
+	store := NewMemoryStore()
+	rateLimiter, err := NewCompositeLimiter("compositeToken", compositeRules, WithStore(store))
+	c.Assert(err, IsNil)
+
+	assertCompositeRules(c, rateLimiter, func() int {
+		count := 0
+		for _, counter := range store.states["compositeToken_rateLimiterToken"].ruleCounters[200] {
+			count += counter
+		}
+		return count
+	})
+}
+
+// TestCompositeLimiterExceedingRule tests that a request costing more than
+// the tightest rule is rejected right away
+func (t *CompositeLimiterTest) TestCompositeLimiterExceedingRule(c *C) {
+	rateLimiter, err := NewCompositeLimiter("compositeToken", compositeRules, WithStore(NewMemoryStore()))
+	c.Assert(err, IsNil)
+
+	_, err = rateLimiter.TryEnterN(3)
+	c.Assert(err, ErrorMatches, ".*3 requests exceed the max of 2.*")
+
+	_, err = rateLimiter.Reserve()
+	c.Assert(err, NotNil)
+}
+
+// TestCompositeLimiterValidation tests that invalid rules are turned down
+func (t *CompositeLimiterTest) TestCompositeLimiterValidation(c *C) {
+	store := WithStore(NewMemoryStore())
+
+	_, err := NewCompositeLimiter("compositeToken", nil, store)
+	c.Assert(err, ErrorMatches, ".*At least one rule.*")
+
+	_, err = NewCompositeLimiter("compositeToken", []Rule{{MaxRequests: 0, Interval: time.Second}}, store)
+	c.Assert(err, NotNil)
+
+	_, err = NewCompositeLimiter("compositeToken", []Rule{{MaxRequests: 1, Interval: 0}}, store)
+	c.Assert(err, NotNil)
+
+	_, err = NewCompositeLimiter("compositeToken", []Rule{
+		{MaxRequests: 1, Interval: time.Second},
+		{MaxRequests: 2, Interval: time.Second},
+	}, store)
+	c.Assert(err, ErrorMatches, ".*more than one rule.*")
+
+	_, err = NewCompositeLimiter("compositeToken", compositeRules, store, WithStrategy(GCRA))
+	c.Assert(err, ErrorMatches, ".*SlidingWindowCounter.*")
+}
@@ -0,0 +1,238 @@
+package funnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/meshhq/meshRedis"
+)
+
+const (
+	// defaultLeaseTTL is the default time (in ms) a lease is held for w/out
+	// being renewed
+	defaultLeaseTTL = 10000
+
+	// defaultAcquireDelay is the default time (in ms) to wait between attempts
+	// to acquire a lease
+	defaultAcquireDelay = 50
+)
+
+// ConcurrencyInfo provides the sufficient information to create a
+// ConcurrencyLimiter
+type ConcurrencyInfo struct {
+	// Token is the unique token that is used for tracking the limited resource
+	Token string
+
+	// MaxConcurrent is the maximum amount of leases that can be held at once
+	MaxConcurrent int
+
+	// LeaseTTL is the time (in ms) a lease is held for w/out being renewed. Leases are
+	// renewed in the background while held, so this only matters when a holder crashes.
+	// Defaults to 10 seconds
+	LeaseTTL int64
+
+	// Logger receives the events of the limiter, such as failed renewals.
+	// Defaults to a logger that drops them
+	Logger Logger
+}
+
+// ConcurrencyLimiter limits the amount of simultaneous holders of a resource
+// across processes, such as the connections to a server. Leases expire on
+// the clock of redis, rather than on the one of each holder. All time is in
+// milliseconds
+type ConcurrencyLimiter struct {
+	// pool is a reference to a struct that vendors a redigo connection
+	pool meshRedis.RedPool
+
+	// token is the unique token that is used for tracking the limited
+	// resource
+	token string
+
+	// maxConcurrent is the maximum amount of leases that can be held at once
+	maxConcurrent int
+
+	// leaseTTL is the time a lease is held for w/out being renewed
+	leaseTTL int64
+
+	// delay is the time to wait between attempts to acquire a lease
+	delay int64
+
+	// factor is the factor used to change the retry attempt
+	factor float64
+
+	// logger receives the events of the limiter
+	logger Logger
+}
+
+// Lease is a slot held in a ConcurrencyLimiter. It is renewed in the
+// background until it is released
+type Lease struct {
+	// limiter is the limiter the lease is held in
+	limiter *ConcurrencyLimiter
+
+	// id is the unique id of the lease
+	id string
+
+	// once guards the release of the lease
+	once sync.Once
+
+	// stop ends the renewal of the lease
+	stop chan struct{}
+
+	// done is closed once the lease is released or lost
+	done chan struct{}
+}
+
+// NewConcurrencyLimiter is a factory method for creating a concurrency
+// limiter on the meshRedis pool
+func NewConcurrencyLimiter(info *ConcurrencyInfo) (*ConcurrencyLimiter, error) {
+	pool := meshRedis.UnderlyingPool()
+	if pool == nil {
+		return nil, fmt.Errorf("Failed to acquire Redis pool. Check that meshRedis is connected.")
+	}
+	return NewConcurrencyLimiterWithPool(pool, info)
+}
+
+// NewConcurrencyLimiterWithPool is a factory method for creating a
+// concurrency limiter on the given pool rather than the meshRedis one
+func NewConcurrencyLimiterWithPool(pool meshRedis.RedPool, info *ConcurrencyInfo) (*ConcurrencyLimiter, error) {
+	if pool == nil {
+		return nil, errors.New("Unable to create the concurrency limiter. A Redis pool is required")
+	}
+
+	if info.MaxConcurrent <= 0 {
+		return nil, errors.New("Unable to create the concurrency limiter. A positive MaxConcurrent is required")
+	}
+
+	leaseTTL := info.LeaseTTL
+	if leaseTTL == 0 {
+		leaseTTL = defaultLeaseTTL
+	}
+	if leaseTTL < 0 {
+		return nil, errors.New("Unable to create the concurrency limiter. The LeaseTTL can't be negative")
+	}
+
+	limiter := &ConcurrencyLimiter{
+		token:         info.Token + "_concurrencyLimiterToken",
+		maxConcurrent: info.MaxConcurrent,
+		leaseTTL:      leaseTTL,
+		delay:         defaultAcquireDelay,
+		factor:        defaultFactor,
+		logger:        loggerOrNop(info.Logger),
+	}
+	limiter.pool = pool
+	return limiter, nil
+}
+
+// Acquire waits for a lease in the limiter, giving up as soon as ctx is done.
+// The lease must be released once the resource is no longer in use
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) (*Lease, error) {
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		lease, err := l.TryAcquire()
+		if lease != nil {
+			return lease, nil
+		}
+
+		// Sleep w/ a randomness factor
+		wait := jitter(l.factor, l.delay)
+		if err != nil {
+			l.logger.Error("Unable to acquire a lease in the concurrency limiter", Fields{Token: l.token, Attempt: attempt, Wait: wait, Err: err})
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// TryAcquire makes a single attempt to acquire a lease w/out blocking. A nil
+// lease is returned when all of them are held
+func (l *ConcurrencyLimiter) TryAcquire() (*Lease, error) {
+	id := newEntryID()
+	acquired, err := redis.Bool(runOnKey(l.pool, l.leasesToken(), func(conn redis.Conn) (interface{}, error) {
+		return evalScript(conn, acquireLeaseScript, l.leasesToken(), id, l.maxConcurrent, l.leaseTTL)
+	}))
+	if err != nil || !acquired {
+		return nil, storeError(err)
+	}
+
+	lease := &Lease{
+		limiter: l,
+		id:      id,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go lease.renew()
+	return lease, nil
+}
+
+// Holders returns the amount of leases currently held
+func (l *ConcurrencyLimiter) Holders() (int, error) {
+	holders, err := redis.Int(runOnKey(l.pool, l.leasesToken(), func(conn redis.Conn) (interface{}, error) {
+		return evalScript(conn, countLeasesScript, l.leasesToken())
+	}))
+	return holders, storeError(err)
+}
+
+// leasesToken is the token used for the leases currently held
+func (l *ConcurrencyLimiter) leasesToken() string {
+	return hashTag(l.token) + "_leases"
+}
+
+// Release gives the lease back to the limiter. Releasing a lease more than
+// once does nothing
+func (l *Lease) Release() error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+
+		_, err = runOnKey(l.limiter.pool, l.limiter.leasesToken(), func(conn redis.Conn) (interface{}, error) {
+			return conn.Do("ZREM", l.limiter.leasesToken(), l.id)
+		})
+	})
+	return storeError(err)
+}
+
+// Done returns a channel that is closed once the lease is released, or lost
+// because it couldn't be renewed before it expired
+func (l *Lease) Done() <-chan struct{} {
+	return l.done
+}
+
+// renew heartbeats the lease every third of its TTL, until it is released or
+// found to be lost
+func (l *Lease) renew() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(time.Duration(l.limiter.leaseTTL) * time.Millisecond / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		renewed, err := redis.Bool(runOnKey(l.limiter.pool, l.limiter.leasesToken(), func(conn redis.Conn) (interface{}, error) {
+			return evalScript(conn, renewLeaseScript, l.limiter.leasesToken(), l.id, l.limiter.leaseTTL)
+		}))
+
+		// A failed heartbeat is retried on the next tick, the lease is only
+		// lost once redis says so
+		if err != nil {
+			l.limiter.logger.Error("Unable to renew the lease in the concurrency limiter", Fields{Token: l.limiter.token, Err: storeError(err)})
+			continue
+		}
+		if !renewed {
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package funnel
+
+import (
+	"context"
+	"time"
+)
+
+import (
+	"github.com/meshhq/meshRedis"
+	. "gopkg.in/check.v1"
+)
+
+type ConcurrencyLimiterTest struct{}
+
+var _ = Suite(&ConcurrencyLimiterTest{})
+
+func (s *ConcurrencyLimiterTest) SetUpSuite(c *C) {
+	err := meshRedis.SetupRedis()
+	c.Assert(err, Equals, nil)
+}
+
+func (s *ConcurrencyLimiterTest) TearDownSuite(c *C) {
+	err := meshRedis.ClosePool()
+	c.Assert(err, Equals, nil)
+}
+
+// newConcurrencyLimiter creates a cleared concurrency limiter
+func newConcurrencyLimiter(c *C, token string, max int, ttl int64) *ConcurrencyLimiter {
+	info := &ConcurrencyInfo{
+		Token:         token,
+		MaxConcurrent: max,
+		LeaseTTL:      ttl,
+	}
+
+	limiter, err := NewConcurrencyLimiter(info)
+	c.Assert(err, IsNil)
+
+	session := meshRedis.NewSession()
+	defer session.CloseSession()
+	c.Assert(session.Delete(limiter.leasesToken()), IsNil)
+	return limiter
+}
+
+// TestTryAcquireUntilFull tests that leases are handed out up to the max, and
+// that releasing one makes room for another
+func (s *ConcurrencyLimiterTest) TestTryAcquireUntilFull(c *C) {
+	limiter := newConcurrencyLimiter(c, "tryAcquireToken", 2, 0)
+
+	first, err := limiter.TryAcquire()
+	c.Assert(err, IsNil)
+	c.Assert(first, NotNil)
+	second, err := limiter.TryAcquire()
+	c.Assert(err, IsNil)
+	c.Assert(second, NotNil)
+
+	third, err := limiter.TryAcquire()
+	c.Assert(err, IsNil)
+	c.Assert(third, IsNil)
+
+	holders, err := limiter.Holders()
+	c.Assert(err, IsNil)
+	c.Assert(holders, Equals, 2)
+
+	c.Assert(first.Release(), IsNil)
+	c.Assert(first.Release(), IsNil)
+	<-first.Done()
+
+	third, err = limiter.TryAcquire()
+	c.Assert(err, IsNil)
+	c.Assert(third, NotNil)
+
+	c.Assert(second.Release(), IsNil)
+	c.Assert(third.Release(), IsNil)
+}
+
+// TestAcquireWaitsForRelease tests that Acquire blocks until a lease is
+// released
+func (s *ConcurrencyLimiterTest) TestAcquireWaitsForRelease(c *C) {
+	limiter := newConcurrencyLimiter(c, "acquireWaitToken", 1, 0)
+
+	held, err := limiter.Acquire(context.Background())
+	c.Assert(err, IsNil)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		held.Release()
+	}()
+
+	beginTime := unixInMilliseconds()
+	lease, err := limiter.Acquire(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(unixInMilliseconds()-beginTime >= 200, Equals, true)
+	c.Assert(lease.Release(), IsNil)
+}
+
+// TestAcquireWithDeadline tests that Acquire gives up once its context is
+// done
+func (s *ConcurrencyLimiterTest) TestAcquireWithDeadline(c *C) {
+	limiter := newConcurrencyLimiter(c, "acquireDeadlineToken", 1, 0)
+
+	held, err := limiter.Acquire(context.Background())
+	c.Assert(err, IsNil)
+	defer held.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	lease, err := limiter.Acquire(ctx)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(lease, IsNil)
+}
+
+// TestLeaseIsRenewed tests that a held lease outlives its TTL
+func (s *ConcurrencyLimiterTest) TestLeaseIsRenewed(c *C) {
+	limiter := newConcurrencyLimiter(c, "leaseRenewToken", 1, 300)
+
+	held, err := limiter.Acquire(context.Background())
+	c.Assert(err, IsNil)
+
+	time.Sleep(time.Second)
+	lease, err := limiter.TryAcquire()
+	c.Assert(err, IsNil)
+	c.Assert(lease, IsNil)
+	c.Assert(held.Release(), IsNil)
+}
+
+// TestCrashedHolderLeaseExpires tests that a lease that stops being renewed
+// frees its slot once its TTL runs out
+func (s *ConcurrencyLimiterTest) TestCrashedHolderLeaseExpires(c *C) {
+	limiter := newConcurrencyLimiter(c, "leaseExpireToken", 1, 300)
+
+	held, err := limiter.Acquire(context.Background())
+	c.Assert(err, IsNil)
+
+	// Stop the heartbeat as if the holder crashed
+	close(held.stop)
+	<-held.Done()
+
+	time.Sleep(350 * time.Millisecond)
+	lease, err := limiter.TryAcquire()
+	c.Assert(err, IsNil)
+	c.Assert(lease, NotNil)
+	c.Assert(lease.Release(), IsNil)
+}
@@ -0,0 +1,85 @@
+package funnel
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrLimitExceeded is matched by the errors returned when a request is
+	// turned down by the limiter. The error is a *LimitError, which tells
+	// when to retry
+	ErrLimitExceeded = errors.New("Unable to process request. The rate limit was exceeded")
+
+	// ErrBackendUnavailable is matched by the errors returned when the store
+	// of a limiter can't be reached. The error of the store is wrapped in it
+	ErrBackendUnavailable = errors.New("Unable to process request. The store of the limiter is unavailable")
+
+	// ErrLockTimeout is returned when the lock on the limiter couldn't be
+	// taken in time, such as the Redlock lock of a QuorumStore
+	ErrLockTimeout = errors.New("Unable to process request. Timed out taking the lock on the limiter")
+)
+
+// LimitError is returned when a request is turned down by the limiter. It
+// matches ErrLimitExceeded w/ errors.Is
+type LimitError struct {
+	// Key is the token of the limiter that turned the request down, which
+	// is one of its parents for a nested limiter
+	Key string
+
+	// Limit is the most requests the limiter that turned the request down
+	// admits at once
+	Limit int
+
+	// Remaining is the amount of requests the limiter that turned the
+	// request down still admitted, as read from its store right after. It is
+	// less than the request needed, and 0 when it couldn't be read
+	Remaining int
+
+	// RetryAfter is how long until the limiter has room for the request, or
+	// InfDuration when it never will, such as a request larger than the share
+	// of a degraded limiter
+	RetryAfter time.Duration
+}
+
+// Error describes the request that was turned down
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("Unable to process request. Max attempts hit in the Rate Limiter for %s. Retry after %s", e.Key, e.RetryAfter)
+}
+
+// Is reports whether target is ErrLimitExceeded
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// backendError wraps an error of the store, so that it matches
+// ErrBackendUnavailable while the original error stays reachable
+type backendError struct {
+	// err is the error of the store
+	err error
+}
+
+// Error describes the error of the store
+func (e *backendError) Error() string {
+	return ErrBackendUnavailable.Error() + ". " + e.err.Error()
+}
+
+// Is reports whether target is ErrBackendUnavailable
+func (e *backendError) Is(target error) bool {
+	return target == ErrBackendUnavailable
+}
+
+// Unwrap returns the error of the store
+func (e *backendError) Unwrap() error {
+	return e.err
+}
+
+// storeError wraps an error of the store so that it matches
+// ErrBackendUnavailable. Errors that are already typed are left alone
+func storeError(err error) error {
+	if err == nil || errors.Is(err, ErrBackendUnavailable) || errors.Is(err, ErrLockTimeout) {
+		return err
+	}
+	return &backendError{err: err}
+}
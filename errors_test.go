@@ -0,0 +1,115 @@
+package funnel
+
+import (
+	"errors"
+	"time"
+)
+
+import (
+	"github.com/garyburd/redigo/redis"
+	. "gopkg.in/check.v1"
+)
+
+// ErrorsTest checks that errors can be told apart w/ errors.Is and errors.As
+type ErrorsTest struct{}
+
+var _ = Suite(&ErrorsTest{})
+
+//---------
+// Test Errors
+//---------
+
+// TestLimitExceeded tests that a request turned down after its retries
+// returns a LimitError
+func (e *ErrorsTest) TestLimitExceeded(c *C) {
+	rateLimiter, err := NewLimiterWithStore(NewMemoryStore(), &RateLimitInfo{
+		Token:        "exceededToken",
+		MaxRequests:  2,
+		TimeInterval: 1000,
+	}, WithRetries(2), WithRetryDelay(time.Millisecond))
+	c.Assert(err, IsNil)
+	c.Assert(rateLimiter.EnterN(2), IsNil)
+
+	err = rateLimiter.Enter()
+	c.Assert(errors.Is(err, ErrLimitExceeded), Equals, true)
+	c.Assert(errors.Is(err, ErrBackendUnavailable), Equals, false)
+
+	var limitErr *LimitError
+	c.Assert(errors.As(err, &limitErr), Equals, true)
+	c.Assert(limitErr.Key, Equals, "exceededToken")
+	c.Assert(limitErr.Limit, Equals, 2)
+	c.Assert(limitErr.Remaining, Equals, 0)
+	c.Assert(limitErr.RetryAfter > 900*time.Millisecond, Equals, true)
+	c.Assert(limitErr.RetryAfter <= time.Second, Equals, true)
+}
+
+// TestLimitErrorRemaining tests that a LimitError carries the room that was
+// left, which was too little for the request
+func (e *ErrorsTest) TestLimitErrorRemaining(c *C) {
+	rateLimiter, err := NewLimiterWithStore(NewMemoryStore(), &RateLimitInfo{
+		Token:        "remainingToken",
+		MaxRequests:  5,
+		TimeInterval: 1000,
+	}, WithRetries(1), WithRetryDelay(time.Millisecond))
+	c.Assert(err, IsNil)
+	c.Assert(rateLimiter.EnterN(3), IsNil)
+
+	var limitErr *LimitError
+	c.Assert(errors.As(rateLimiter.EnterN(3), &limitErr), Equals, true)
+	c.Assert(limitErr.Remaining, Equals, 2)
+
+	admitted, limitErr, err := rateLimiter.TryEnterWithLimit()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+	c.Assert(limitErr, IsNil)
+
+	_, limitErr, err = rateLimiter.TryEnterWithLimit()
+	c.Assert(err, IsNil)
+	c.Assert(limitErr, IsNil)
+
+	_, limitErr, err = rateLimiter.TryEnterWithLimit()
+	c.Assert(err, IsNil)
+	c.Assert(limitErr, NotNil)
+	c.Assert(limitErr.Remaining, Equals, 0)
+}
+
+// TestBackendUnavailable tests that the errors of the store match
+// ErrBackendUnavailable, and still wrap the error of the store
+func (e *ErrorsTest) TestBackendUnavailable(c *C) {
+	rateLimiter, store := newFlakyLimiter(c, 10, WithRetries(2), WithRetryDelay(time.Millisecond))
+
+	_, err := rateLimiter.TryEnter()
+	c.Assert(errors.Is(err, ErrBackendUnavailable), Equals, true)
+	c.Assert(errors.Is(err, ErrLimitExceeded), Equals, false)
+	c.Assert(errors.Unwrap(err), ErrorMatches, "Store is down")
+
+	err = rateLimiter.Enter()
+	c.Assert(errors.Is(err, ErrBackendUnavailable), Equals, true)
+	c.Assert(store.takes, Equals, int32(3))
+}
+
+// TestLockTimeout tests that a QuorumStore that can't take its lock in time
+// returns ErrLockTimeout
+func (e *ErrorsTest) TestLockTimeout(c *C) {
+	pools := []*redis.Pool{newTestPool(2), newTestPool(3), newTestPool(4)}
+	rateLimiter := newQuorumLimiter(c, "lockTimeoutToken", 10, pools...)
+
+	// Hold the lock on every node
+	lockToken := rateLimiter.limit().lockToken()
+	for _, pool := range pools {
+		conn := pool.Get()
+		_, err := conn.Do("SET", lockToken, "held", "PX", 5000)
+		conn.Close()
+		c.Assert(err, IsNil)
+	}
+	defer func() {
+		for _, pool := range pools {
+			conn := pool.Get()
+			conn.Do("DEL", lockToken)
+			conn.Close()
+		}
+	}()
+
+	_, err := rateLimiter.TryEnter()
+	c.Assert(err, Equals, ErrLockTimeout)
+}
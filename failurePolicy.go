@@ -0,0 +1,218 @@
+package funnel
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultRecoveryInterval is the time (in ms) to wait before trying the store
+// again once it failed, when the failure policy admits requests w/out it
+const defaultRecoveryInterval = 1000
+
+// FailurePolicy is what a RateLimiter does when its store is unavailable
+type FailurePolicy int
+
+const (
+	// FailRetry keeps retrying the store in Enter, until it recovers or the
+	// retries run out. Single attempts return the error of the store. It is
+	// the default
+	FailRetry FailurePolicy = iota
+
+	// FailClosed returns the error of the store right away, so requests are
+	// turned down while the store is unavailable
+	FailClosed
+
+	// FailOpen admits every request while the store is unavailable
+	FailOpen
+
+	// FailLocal limits the requests in the process while the store is
+	// unavailable, w/ the MaxRequests split evenly across the expected
+	// replicas of the process
+	FailLocal
+)
+
+// String returns the name of the failure policy
+func (f FailurePolicy) String() string {
+	switch f {
+	case FailRetry:
+		return "FailRetry"
+	case FailClosed:
+		return "FailClosed"
+	case FailOpen:
+		return "FailOpen"
+	case FailLocal:
+		return "FailLocal"
+	}
+	return "Unknown"
+}
+
+// Mode is whether a RateLimiter admits requests through its store, or
+// through its failure policy
+type Mode int
+
+const (
+	// ModeNormal admits requests through the store
+	ModeNormal Mode = iota
+
+	// ModeDegraded admits requests through the failure policy, because the
+	// store is unavailable
+	ModeDegraded
+)
+
+// String returns the name of the mode
+func (m Mode) String() string {
+	if m == ModeDegraded {
+		return "Degraded"
+	}
+	return "Normal"
+}
+
+// degradation tracks whether a RateLimiter is admitting requests through its
+// failure policy
+type degradation struct {
+	// mutex guards the mode and the time to try the store at
+	mutex sync.Mutex
+
+	// mode is the current mode
+	mode Mode
+
+	// retryStoreAt is the time (in ms) the store is tried again at while
+	// degraded
+	retryStoreAt int64
+
+	// local keeps the state of the FailLocal policy
+	local *MemoryStore
+}
+
+// WithFailurePolicy sets what the limiter does when its store is
+// unavailable. Defaults to FailRetry
+func WithFailurePolicy(policy FailurePolicy) Option {
+	return func(r *RateLimiter) error {
+		if policy < FailRetry || policy > FailLocal {
+			return errors.New("Unable to create the rate limiter. Unknown failure policy")
+		}
+		r.failurePolicy = policy
+		return nil
+	}
+}
+
+// WithExpectedReplicas sets the amount of processes expected to share the
+// limiter, which the FailLocal policy splits the MaxRequests across.
+// Defaults to 1
+func WithExpectedReplicas(replicas int) Option {
+	return func(r *RateLimiter) error {
+		if replicas <= 0 {
+			return errors.New("Unable to create the rate limiter. The expected replicas must be positive")
+		}
+		r.expectedReplicas = replicas
+		return nil
+	}
+}
+
+// WithRecoveryInterval sets the time the limiter waits before trying its
+// store again once it failed, while the FailOpen or FailLocal policy admits
+// requests w/out it. Defaults to 1 second
+func WithRecoveryInterval(interval time.Duration) Option {
+	return func(r *RateLimiter) error {
+		if interval < time.Millisecond {
+			return errors.New("Unable to create the rate limiter. The recovery interval must be at least 1ms")
+		}
+		r.recoveryInterval = int64(interval / time.Millisecond)
+		return nil
+	}
+}
+
+// WithModeChange sets a callback for when the limiter switches between
+// admitting requests through its store and through its failure policy
+func WithModeChange(onModeChange func(Mode)) Option {
+	return func(r *RateLimiter) error {
+		r.onModeChange = onModeChange
+		return nil
+	}
+}
+
+// Mode returns whether the limiter is admitting requests through its store,
+// or through its failure policy
+func (r *RateLimiter) Mode() Mode {
+	r.degradation.mutex.Lock()
+	defer r.degradation.mutex.Unlock()
+	return r.degradation.mode
+}
+
+// degraded reports whether the store should be skipped, because it failed
+// recently and the failure policy admits requests w/out it
+func (r *RateLimiter) degraded(now int64) bool {
+	if r.failurePolicy != FailOpen && r.failurePolicy != FailLocal {
+		return false
+	}
+
+	r.degradation.mutex.Lock()
+	defer r.degradation.mutex.Unlock()
+	return r.degradation.mode == ModeDegraded && now < r.degradation.retryStoreAt
+}
+
+// setMode switches the limiter into the mode, and calls back when it changed
+func (r *RateLimiter) setMode(mode Mode, now int64) {
+	r.degradation.mutex.Lock()
+	changed := r.degradation.mode != mode
+	r.degradation.mode = mode
+	if mode == ModeDegraded {
+		r.degradation.retryStoreAt = now + r.recoveryInterval
+	}
+	r.degradation.mutex.Unlock()
+
+	if changed && r.onModeChange != nil {
+		r.onModeChange(mode)
+	}
+}
+
+// takeDegraded takes room for n requests through the failure policy
+func (r *RateLimiter) takeDegraded(n int, now int64, wait int64) (TakeResult, error) {
+	if r.failurePolicy == FailOpen {
+		return TakeResult{Admitted: true, Degraded: true}, nil
+	}
+
+	result, err := r.degradation.local.Take(r.localLimit(), n, now, wait)
+	result.Degraded = true
+	return result, err
+}
+
+// localLimit describes the share of the limiter that a single replica gets
+// under the FailLocal policy, in the limiter and every limiter above it
+func (r *RateLimiter) localLimit() *Limit {
+	limit := r.limit()
+	if r.expectedReplicas <= 1 {
+		return limit
+	}
+	return shareLimit(limit, r.expectedReplicas)
+}
+
+// shareLimit divides the limit and every limit above it across the replicas
+func shareLimit(l *Limit, replicas int) *Limit {
+	limit := *l
+	if limit.Parent != nil {
+		limit.Parent = shareLimit(limit.Parent, replicas)
+	}
+
+	limit.MaxRequests = limit.MaxRequests / replicas
+	if limit.MaxRequests < 1 {
+		limit.MaxRequests = 1
+	}
+	limit.Burst = limit.Burst / replicas
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	limit.EmissionInterval = limit.EmissionInterval * float64(replicas)
+
+	rules := make([]Rule, len(limit.Rules))
+	for i, rule := range limit.Rules {
+		rules[i] = rule
+		rules[i].MaxRequests = rule.MaxRequests / replicas
+		if rules[i].MaxRequests < 1 {
+			rules[i].MaxRequests = 1
+		}
+	}
+	limit.Rules = rules
+	return &limit
+}
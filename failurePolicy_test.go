@@ -0,0 +1,171 @@
+package funnel
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+// FailurePolicyTest uses a store that can be taken down, so it needs no redis
+type FailurePolicyTest struct{}
+
+var _ = Suite(&FailurePolicyTest{})
+
+// flakyStore is an in-memory store that can be taken down
+type flakyStore struct {
+	*MemoryStore
+
+	// down is 1 while the store is unavailable
+	down int32
+
+	// takes counts the calls that reached the store
+	takes int32
+}
+
+func (f *flakyStore) Take(limit *Limit, n int, now int64, wait int64) (TakeResult, error) {
+	atomic.AddInt32(&f.takes, 1)
+	if atomic.LoadInt32(&f.down) == 1 {
+		return TakeResult{}, errors.New("Store is down")
+	}
+	return f.MemoryStore.Take(limit, n, now, wait)
+}
+
+// newFlakyLimiter creates a limiter on a store that is down
+func newFlakyLimiter(c *C, max int, opts ...Option) (*RateLimiter, *flakyStore) {
+	store := &flakyStore{MemoryStore: NewMemoryStore(), down: 1}
+	rateLimiter, err := NewLimiterWithStore(store, &RateLimitInfo{
+		Token:        "flakyToken",
+		MaxRequests:  max,
+		TimeInterval: 1000,
+	}, opts...)
+	c.Assert(err, IsNil)
+	return rateLimiter, store
+}
+
+//---------
+// Test Policies
+//---------
+
+// TestFailRetry tests that Enter keeps retrying a store that is down by
+// default, until the retries run out
+func (f *FailurePolicyTest) TestFailRetry(c *C) {
+	rateLimiter, store := newFlakyLimiter(c, 10, WithRetries(3), WithRetryDelay(time.Millisecond))
+
+	err := rateLimiter.Enter()
+	c.Assert(errors.Is(err, ErrBackendUnavailable), Equals, true)
+	c.Assert(store.takes, Equals, int32(3))
+}
+
+// TestFailClosed tests that Enter returns the error of the store right away
+func (f *FailurePolicyTest) TestFailClosed(c *C) {
+	rateLimiter, store := newFlakyLimiter(c, 10, WithFailurePolicy(FailClosed))
+
+	err := rateLimiter.Enter()
+	c.Assert(errors.Is(err, ErrBackendUnavailable), Equals, true)
+	c.Assert(store.takes, Equals, int32(1))
+	c.Assert(rateLimiter.Mode(), Equals, ModeNormal)
+}
+
+// TestFailOpen tests that every request is admitted while the store is down
+func (f *FailurePolicyTest) TestFailOpen(c *C) {
+	var modes []Mode
+	rateLimiter, _ := newFlakyLimiter(c, 1, WithFailurePolicy(FailOpen), WithModeChange(func(mode Mode) {
+		modes = append(modes, mode)
+	}))
+
+	for i := 0; i < 5; i++ {
+		c.Assert(rateLimiter.Enter(), IsNil)
+	}
+	c.Assert(rateLimiter.Mode(), Equals, ModeDegraded)
+	c.Assert(modes, DeepEquals, []Mode{ModeDegraded})
+}
+
+// TestFailLocal tests that the process gets its share of the max while the
+// store is down
+func (f *FailurePolicyTest) TestFailLocal(c *C) {
+	rateLimiter, _ := newFlakyLimiter(c, 10, WithFailurePolicy(FailLocal), WithExpectedReplicas(5))
+
+	admitted, err := rateLimiter.TryEnterN(2)
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+
+	admitted, err = rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+}
+
+// TestFailLocalTooLarge tests that a request larger than the share of the
+// process is turned down right away, rather than retried
+func (f *FailurePolicyTest) TestFailLocalTooLarge(c *C) {
+	rateLimiter, _ := newFlakyLimiter(c, 10, WithFailurePolicy(FailLocal), WithExpectedReplicas(5),
+		WithRetries(1000), WithRetryDelay(100*time.Millisecond))
+
+	beginTime := time.Now()
+	err := rateLimiter.EnterN(3)
+	var limitErr *LimitError
+	c.Assert(errors.As(err, &limitErr), Equals, true)
+	c.Assert(limitErr.RetryAfter, Equals, InfDuration)
+	c.Assert(time.Since(beginTime) < 50*time.Millisecond, Equals, true)
+}
+
+// TestFailLocalParentShare tests that the limits of the parents are split
+// across the replicas as well
+func (f *FailurePolicyTest) TestFailLocalParentShare(c *C) {
+	store := &flakyStore{MemoryStore: NewMemoryStore(), down: 1}
+	global, err := New("flakyGlobalToken", 4, time.Minute, WithStore(store), WithStrategy(SlidingWindowCounter))
+	c.Assert(err, IsNil)
+	tenant, err := New("flakyTenantToken", 10, time.Minute, WithStrategy(SlidingWindowCounter), WithParent(global),
+		WithFailurePolicy(FailLocal), WithExpectedReplicas(2))
+	c.Assert(err, IsNil)
+
+	assertAdmits(c, tenant, true)
+	assertAdmits(c, tenant, true)
+	assertAdmits(c, tenant, false)
+}
+
+// TestRecovery tests that the limiter goes back to its store once it
+// recovers, and only tries it again after the recovery interval
+func (f *FailurePolicyTest) TestRecovery(c *C) {
+	var modes []Mode
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	rateLimiter, store := newFlakyLimiter(c, 10, WithFailurePolicy(FailLocal), WithClock(clock),
+		WithRecoveryInterval(5*time.Second), WithModeChange(func(mode Mode) {
+			modes = append(modes, mode)
+		}))
+
+	c.Assert(rateLimiter.Enter(), IsNil)
+	c.Assert(rateLimiter.Enter(), IsNil)
+	c.Assert(store.takes, Equals, int32(1))
+
+	// The store isn't tried again until the recovery interval is over
+	atomic.StoreInt32(&store.down, 0)
+	clock.now = clock.now.Add(4 * time.Second)
+	c.Assert(rateLimiter.Enter(), IsNil)
+	c.Assert(store.takes, Equals, int32(1))
+	c.Assert(rateLimiter.Mode(), Equals, ModeDegraded)
+
+	clock.now = clock.now.Add(time.Second)
+	c.Assert(rateLimiter.Enter(), IsNil)
+	c.Assert(store.takes, Equals, int32(2))
+	c.Assert(rateLimiter.Mode(), Equals, ModeNormal)
+	c.Assert(modes, DeepEquals, []Mode{ModeDegraded, ModeNormal})
+}
+
+// TestInvalidFailureOptions tests that limiters can't be created w/ invalid
+// failure options
+func (f *FailurePolicyTest) TestInvalidFailureOptions(c *C) {
+	limiterInfo := &RateLimitInfo{Token: "flakyToken", MaxRequests: 1}
+
+	_, err := NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithFailurePolicy(FailurePolicy(9)))
+	c.Assert(err, NotNil)
+
+	_, err = NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithExpectedReplicas(0))
+	c.Assert(err, NotNil)
+
+	_, err = NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithRecoveryInterval(0))
+	c.Assert(err, ErrorMatches, ".*recovery interval must be at least 1ms.*")
+}
@@ -0,0 +1,247 @@
+package funnel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultQueuePoll is the time waiters of the fair queue wait per ticket
+// ahead of them, before they check whether it is their turn again
+const defaultQueuePoll = 5 * time.Millisecond
+
+// TicketQueue is implemented by stores that can queue the waiters of a
+// limiter, so that they are admitted in the order they arrived in. Each
+// ticket is held for a time (in ms) and renewed while its waiter is still
+// waiting, so the ticket of a waiter that crashed expires. All time is in ms
+type TicketQueue interface {
+	// Enqueue hands out the next ticket of the limiter described by limit,
+	// held until now + ttl
+	Enqueue(limit *Limit, now int64, ttl int64) (int64, error)
+
+	// Turn renews the ticket until now + ttl, and counts the tickets ahead of
+	// it that haven't expired, which is 0 when it is its turn. A ticket that
+	// expired while its waiter was still waiting takes back its place
+	Turn(limit *Limit, ticket int64, now int64, ttl int64) (int64, error)
+
+	// Waiting counts the tickets in the queue that haven't expired
+	Waiting(limit *Limit, now int64) (int64, error)
+
+	// Leave removes the ticket from the queue
+	Leave(limit *Limit, ticket int64) error
+}
+
+// WithFairQueue makes Enter admit its waiters in the order they arrived in,
+// across every process sharing the limiter, rather than leaving it to
+// whoever retries at the right time. Each waiter takes a ticket and only
+// tries for room once the tickets ahead of it were admitted, gave up or
+// expired. The first waiter retries once the store reports room, while the
+// waiters behind it check for their turn again after the poll delay for each
+// ticket ahead of them (see WithQueuePoll), which doesn't use up their
+// retries. A ticket is renewed every time its waiter checks, and expires
+// after the ttl once its waiter crashed. The waits between retries are kept
+// below half the ttl, and the waits between checks below a quarter of it.
+//
+// Only Enter waits in the queue. TryEnter, TryAdmit and reservations would
+// jump it, so they are turned down for as long as any waiter is queued. The
+// store must be a TicketQueue
+func WithFairQueue(ttl time.Duration) Option {
+	return func(r *RateLimiter) error {
+		if ttl < time.Millisecond {
+			return errors.New("Unable to create the rate limiter. The ticket ttl must be at least 1ms")
+		}
+		r.ticketTTL = int64(ttl / time.Millisecond)
+		return nil
+	}
+}
+
+// WithQueuePoll sets the time a waiter of the fair queue waits for each
+// ticket ahead of it, before it checks whether it is its turn again. A waiter
+// further back checks less often, and the waiter right behind the first one
+// is also woken as soon as a waiter of the same process leaves. Defaults to
+// 5ms
+func WithQueuePoll(poll time.Duration) Option {
+	return func(r *RateLimiter) error {
+		if poll < time.Millisecond {
+			return errors.New("Unable to create the rate limiter. The queue poll must be at least 1ms")
+		}
+		r.queuePoll = poll
+		return nil
+	}
+}
+
+// setupFairQueue checks that the limiter can queue its waiters
+func (r *RateLimiter) setupFairQueue() error {
+	if _, ok := r.store.(TicketQueue); !ok {
+		return errors.New("Unable to create the rate limiter. Its store can't queue waiters, which a fair queue needs")
+	}
+	if r.strategy == LeakyBucket {
+		return errors.New("Unable to create the rate limiter. The LeakyBucket strategy already hands out its slots in order")
+	}
+	r.turns = &queueSignal{}
+	return nil
+}
+
+/**
+ * Waiting in Turn
+ */
+
+// takeInTurn takes room for n requests once it is the turn of the ticket,
+// taking a ticket first when the waiter has none. It returns the amount of
+// tickets ahead, since nothing is taken until there are none. Limiters that
+// don't queue their waiters always have their turn
+func (r *RateLimiter) takeInTurn(ticket *int64, n int, now int64) (TakeResult, int64, error) {
+	if r.ticketTTL == 0 || r.degraded(now) {
+		result, err := r.takeAt(n, 0, now)
+		return result, 0, err
+	}
+
+	queue := r.store.(TicketQueue)
+	var err error
+	if *ticket == 0 {
+		*ticket, err = queue.Enqueue(r.limit(), now, r.ticketTTL)
+	}
+
+	var ahead int64
+	if err == nil {
+		ahead, err = queue.Turn(r.limit(), *ticket, now, r.ticketTTL)
+	}
+	if err != nil {
+		// The failure policy decides, as if the store failed to take room
+		if r.failurePolicy == FailOpen || r.failurePolicy == FailLocal {
+			result, err := r.takeAt(n, 0, now)
+			return result, 0, err
+		}
+		return TakeResult{}, 0, storeError(err)
+	}
+	if ahead > 0 {
+		return TakeResult{}, ahead, nil
+	}
+
+	result, err := r.takeAt(n, 0, now)
+	return result, 0, err
+}
+
+// queued reports whether waiters are queued for the limiter, which requests
+// that don't wait in the queue must not jump. The failure policy decides
+// when the store can't tell, as if it failed to take room
+func (r *RateLimiter) queued(now int64) (bool, error) {
+	if r.ticketTTL == 0 || r.degraded(now) {
+		return false, nil
+	}
+
+	waiting, err := r.store.(TicketQueue).Waiting(r.limit(), now)
+	if err != nil {
+		if r.failurePolicy == FailOpen || r.failurePolicy == FailLocal {
+			return false, nil
+		}
+		return false, storeError(err)
+	}
+	return waiting > 0, nil
+}
+
+// waitForTurn waits for the poll delay of every ticket ahead, which is how
+// long waiters of other processes take to notice they left. The waiter right
+// behind the first one is also woken as soon as a waiter of the process
+// leaves the queue, the ones further back wouldn't have their turn anyway
+func (r *RateLimiter) waitForTurn(ctx context.Context, woken <-chan struct{}, ahead int64) error {
+	if ahead > 1 {
+		woken = nil
+	}
+
+	timer := time.NewTimer(r.pollWait(ahead))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-woken:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// leave gives up the place of the ticket in the queue, however the wait
+// ended, and wakes the other waiters of the process
+func (r *RateLimiter) leave(ticket int64) {
+	if ticket == 0 {
+		return
+	}
+
+	if err := r.store.(TicketQueue).Leave(r.limit(), ticket); err != nil {
+		r.logger.Error("Unable to leave the queue of the rate limiter", Fields{Token: r.key(), Err: err})
+	}
+	r.turns.broadcast()
+}
+
+// queueWait caps the wait before the next attempt, so that the ticket of the
+// waiter doesn't expire in the meantime
+func (r *RateLimiter) queueWait(wait time.Duration) time.Duration {
+	if r.ticketTTL == 0 {
+		return wait
+	}
+
+	max := time.Duration(r.ticketTTL/2) * time.Millisecond
+	if wait > max {
+		wait = max
+	}
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// pollWait returns the wait before a waiter w/ the amount of tickets ahead
+// checks for its turn again, capped at a quarter of the ttl so that it
+// renews its ticket well before it expires
+func (r *RateLimiter) pollWait(ahead int64) time.Duration {
+	max := time.Duration(r.ticketTTL/4) * time.Millisecond
+	if ahead > int64(max/r.queuePoll) {
+		ahead = int64(max / r.queuePoll)
+	}
+
+	wait := r.queuePoll * time.Duration(ahead)
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+/**
+ * Signal
+ */
+
+// queueSignal wakes every waiter of a process at once
+type queueSignal struct {
+	// mutex guards the channel
+	mutex sync.Mutex
+
+	// ch is closed to wake the waiters, and replaced for the next wake up
+	ch chan struct{}
+}
+
+// wait returns a channel that is closed on the next broadcast. It is nil
+// for a limiter that doesn't queue its waiters, which never wakes anyone
+func (s *queueSignal) wait() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+// broadcast wakes every waiter that is waiting
+func (s *queueSignal) broadcast() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ch != nil {
+		close(s.ch)
+		s.ch = nil
+	}
+}
@@ -0,0 +1,245 @@
+package funnel
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/garyburd/redigo/redis"
+	. "gopkg.in/check.v1"
+)
+
+// FairQueueTest queues the waiters of limiters on redis, through its own
+// pool, and on a MemoryStore
+type FairQueueTest struct{}
+
+var _ = Suite(&FairQueueTest{})
+
+// newFairLimiter creates a limiter of a request every 50ms that queues its
+// waiters, as if it were in a process of its own
+func newFairLimiter(c *C, store Store, ttl time.Duration) *RateLimiter {
+	rateLimiter, err := New("fairToken", 1, 50*time.Millisecond, WithStore(store),
+		WithFairQueue(ttl), WithRetryDelay(5*time.Millisecond))
+	c.Assert(err, IsNil)
+	return rateLimiter
+}
+
+// clearFairQueue removes the keys of the queue and the window from redis
+func clearFairQueue(c *C, pool *redis.Pool, limit *Limit) {
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", limit.rateLimiterToken(), limit.ticketsToken(), limit.queueToken(), limit.queueLeasesToken())
+	c.Assert(err, IsNil)
+}
+
+// assertFairOrder starts a waiter on each limiter, one after the other, and
+// checks that they are admitted in the order they arrived in
+func assertFairOrder(c *C, limiters []*RateLimiter) {
+	// Fill the window, so that every waiter has to queue
+	c.Assert(limiters[0].Enter(), IsNil)
+
+	var mutex sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i, rateLimiter := range limiters {
+		wg.Add(1)
+		go func(i int, rateLimiter *RateLimiter) {
+			defer wg.Done()
+			c.Check(rateLimiter.Enter(), IsNil)
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+		}(i, rateLimiter)
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+
+	c.Assert(order, DeepEquals, []int{0, 1, 2, 3, 4})
+}
+
+//---------
+// Test Order
+//---------
+
+// TestFairOrderOnRedis tests that the waiters of several limiters sharing
+// redis are admitted in order
+func (f *FairQueueTest) TestFairOrderOnRedis(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	var limiters []*RateLimiter
+	for i := 0; i < 5; i++ {
+		limiters = append(limiters, newFairLimiter(c, NewRedisStore(pool), time.Second))
+	}
+	clearFairQueue(c, pool, limiters[0].limit())
+	assertFairOrder(c, limiters)
+}
+
+// TestFairOrderInMemory tests that the waiters of a MemoryStore are admitted
+// in order
+func (f *FairQueueTest) TestFairOrderInMemory(c *C) {
+	store := NewMemoryStore()
+	var limiters []*RateLimiter
+	for i := 0; i < 5; i++ {
+		limiters = append(limiters, newFairLimiter(c, store, time.Second))
+	}
+	assertFairOrder(c, limiters)
+}
+
+//---------
+// Test Throughput
+//---------
+
+// TestFairQueueThroughput tests that queueing the waiters doesn't slow the
+// limiter down, since the next waiter gets its turn as soon as there is room
+func (f *FairQueueTest) TestFairQueueThroughput(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	for _, store := range []Store{NewRedisStore(pool), NewMemoryStore()} {
+		var limiters []*RateLimiter
+		for i := 0; i < 4; i++ {
+			rateLimiter, err := New("fairThroughputToken", 20, time.Second, WithStore(store), WithFairQueue(time.Second))
+			c.Assert(err, IsNil)
+			limiters = append(limiters, rateLimiter)
+		}
+		clearFairQueue(c, pool, limiters[0].limit())
+
+		// 40 requests at 20/s fit in the current window and the next one
+		beginTime := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 40; i++ {
+			wg.Add(1)
+			go func(rateLimiter *RateLimiter) {
+				defer wg.Done()
+				c.Check(rateLimiter.Enter(), IsNil)
+			}(limiters[i%len(limiters)])
+		}
+		wg.Wait()
+
+		elapsed := time.Since(beginTime)
+		c.Assert(elapsed < 2500*time.Millisecond, Equals, true, Commentf("%s", elapsed))
+	}
+}
+
+//---------
+// Test Abandoned Tickets
+//---------
+
+// TestCrashedWaiterExpires tests that the ticket of a waiter that stopped
+// renewing it no longer holds up the queue once it expires
+func (f *FairQueueTest) TestCrashedWaiterExpires(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	for _, store := range []Store{NewRedisStore(pool), NewMemoryStore()} {
+		rateLimiter := newFairLimiter(c, store, 200*time.Millisecond)
+		clearFairQueue(c, pool, rateLimiter.limit())
+
+		// The waiter takes a ticket and never comes back
+		_, err := store.(TicketQueue).Enqueue(rateLimiter.limit(), rateLimiter.now(), 200)
+		c.Assert(err, IsNil)
+
+		beginTime := time.Now()
+		c.Assert(rateLimiter.Enter(), IsNil)
+		elapsed := time.Since(beginTime)
+		c.Assert(elapsed >= 150*time.Millisecond, Equals, true, Commentf("%s", elapsed))
+		c.Assert(elapsed < time.Second, Equals, true, Commentf("%s", elapsed))
+	}
+}
+
+// TestCancelledWaiterLeaves tests that a waiter that gives up leaves the
+// queue right away, rather than once its ticket expires
+func (f *FairQueueTest) TestCancelledWaiterLeaves(c *C) {
+	store := NewMemoryStore()
+	rateLimiter := newFairLimiter(c, store, time.Minute)
+	queue := TicketQueue(store)
+
+	// A waiter ahead holds the queue up
+	ahead, err := queue.Enqueue(rateLimiter.limit(), rateLimiter.now(), 60000)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Assert(rateLimiter.EnterContext(ctx), Equals, context.DeadlineExceeded)
+
+	c.Assert(queue.Leave(rateLimiter.limit(), ahead), IsNil)
+	beginTime := time.Now()
+	c.Assert(rateLimiter.Enter(), IsNil)
+	c.Assert(time.Since(beginTime) < time.Second, Equals, true)
+}
+
+//---------
+// Test Jumping the Queue
+//---------
+
+// TestQueueIsNotJumped tests that TryEnter and reservations are turned down
+// while waiters are queued, even though there is room
+func (f *FairQueueTest) TestQueueIsNotJumped(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	for _, store := range []Store{NewRedisStore(pool), NewMemoryStore()} {
+		rateLimiter := newFairLimiter(c, store, time.Minute)
+		clearFairQueue(c, pool, rateLimiter.limit())
+		queue := store.(TicketQueue)
+
+		ahead, err := queue.Enqueue(rateLimiter.limit(), rateLimiter.now(), 60000)
+		c.Assert(err, IsNil)
+
+		admitted, limitErr, err := rateLimiter.TryEnterWithLimit()
+		c.Assert(err, IsNil)
+		c.Assert(admitted, Equals, false)
+		c.Assert(limitErr.RetryAfter > 0, Equals, true)
+
+		reservation, err := rateLimiter.Reserve()
+		c.Assert(err, IsNil)
+		c.Assert(reservation.OK(), Equals, false)
+
+		// Once the queue is empty, the room is there to take
+		c.Assert(queue.Leave(rateLimiter.limit(), ahead), IsNil)
+		admitted, err = rateLimiter.TryEnter()
+		c.Assert(err, IsNil)
+		c.Assert(admitted, Equals, true)
+	}
+}
+
+//---------
+// Test Polling
+//---------
+
+// TestPollWaitScalesWithPosition tests that waiters further back check for
+// their turn less often, but still renew their tickets in time
+func (f *FairQueueTest) TestPollWaitScalesWithPosition(c *C) {
+	rateLimiter, err := New("fairToken", 1, time.Second, WithStore(NewMemoryStore()),
+		WithFairQueue(time.Second), WithQueuePoll(10*time.Millisecond))
+	c.Assert(err, IsNil)
+
+	c.Assert(rateLimiter.pollWait(1), Equals, 10*time.Millisecond)
+	c.Assert(rateLimiter.pollWait(5), Equals, 50*time.Millisecond)
+	c.Assert(rateLimiter.pollWait(1000), Equals, 250*time.Millisecond)
+}
+
+//---------
+// Test Options
+//---------
+
+// TestFairQueueValidation tests that limiters that can't queue their waiters
+// are turned down
+func (f *FairQueueTest) TestFairQueueValidation(c *C) {
+	_, err := New("fairToken", 1, time.Second, WithStore(NewMemoryStore()), WithFairQueue(0))
+	c.Assert(err, ErrorMatches, ".*ticket ttl must be at least 1ms.*")
+
+	_, err = New("fairToken", 1, time.Second, WithStore(NewMemoryStore()), WithFairQueue(time.Second), WithQueuePoll(0))
+	c.Assert(err, ErrorMatches, ".*queue poll must be at least 1ms.*")
+
+	_, err = New("fairToken", 1, time.Second, WithStore(NewMemoryStore()), WithFairQueue(time.Second), WithStrategy(LeakyBucket))
+	c.Assert(err, ErrorMatches, ".*already hands out its slots in order.*")
+
+	store, err := NewQuorumStore(newTestPool(2))
+	c.Assert(err, IsNil)
+	_, err = New("fairToken", 1, time.Second, WithStore(store), WithFairQueue(time.Second))
+	c.Assert(err, ErrorMatches, ".*can't queue waiters.*")
+}
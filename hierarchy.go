@@ -0,0 +1,193 @@
+package funnel
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/meshhq/meshRedis"
+)
+
+// WithParent nests the limiter within the parent, such as the quota of a
+// tenant within the quota of a vendor. A request is only admitted when the
+// limiter and every limiter above it have room for it, and then takes room
+// in all of them in a single step, so a level that turns it down costs the
+// others nothing. The LimitError of a request that was turned down names the
+// level that turned it down, as does the one of TryEnterWithLimit.
+//
+// Every level is counted like the SlidingWindowCounter strategy, which is
+// forced on the levels left on the default FixedWindow strategy, the limiter
+// and its parents alike. A parent is switched when the first limiter is
+// nested within it, so it should be nested within before it is used, since
+// the requests it admitted in its fixed window aren't carried over. Levels
+// set to any other strategy are turned down. Every level must share the
+// store, which a limiter w/out a store of its own does. Redis stores share it
+// when they use the same pool. Since the keys of the levels are on different
+// nodes of a redis cluster, a ClusterPool isn't supported
+func WithParent(parent *RateLimiter) Option {
+	return func(r *RateLimiter) error {
+		if parent == nil {
+			return errors.New("Unable to create the rate limiter. The parent can't be nil")
+		}
+		r.parent = parent
+		return nil
+	}
+}
+
+// setupParent checks that the limiter can take room together w/ its parents,
+// and switches the levels on the default FixedWindow strategy to the
+// SlidingWindowCounter one every level is counted like
+func (r *RateLimiter) setupParent() error {
+	for level := r; level != nil; level = level.parent {
+		if level.strategy != SlidingWindowCounter && level.strategy != FixedWindow {
+			return fmt.Errorf("Unable to create the nested limiter. Every level is counted like the SlidingWindowCounter strategy, not the %s one of %s", level.strategy, level.key())
+		}
+		if !sameStore(level.store, r.store) {
+			return fmt.Errorf("Unable to create the nested limiter. Every level must share the store, which %s doesn't", level.key())
+		}
+	}
+
+	if store, ok := r.store.(*RedisStore); ok {
+		if _, ok := store.pool.(*ClusterPool); ok {
+			return errors.New("Unable to create the nested limiter. The keys of the levels are on different nodes of a redis cluster")
+		}
+	}
+
+	// Only levels that were never nested within are switched, so a parent
+	// already in use by other nested limiters isn't written to
+	for level := r; level != nil; level = level.parent {
+		if level.strategy == FixedWindow {
+			level.strategy = SlidingWindowCounter
+		}
+	}
+	return nil
+}
+
+// sameStore reports whether the stores keep their state in the same place,
+// which redis stores do when they use the same pool
+func sameStore(a Store, b Store) bool {
+	if a == b {
+		return true
+	}
+
+	redisA, ok := a.(*RedisStore)
+	if !ok {
+		return false
+	}
+	redisB, ok := b.(*RedisStore)
+	if !ok {
+		return false
+	}
+	return samePool(redisA.pool, redisB.pool)
+}
+
+// samePool reports whether the pools are the same. Pools of a type that
+// can't be compared are never the same, since comparing them panics
+func samePool(a meshRedis.RedPool, b meshRedis.RedPool) bool {
+	if a == nil || b == nil || !reflect.TypeOf(a).Comparable() || !reflect.TypeOf(b).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// ancestor returns the limiter that is the given amount of levels above the
+// limiter, or the limiter itself for 0
+func (r *RateLimiter) ancestor(level int) *RateLimiter {
+	limiter := r
+	for i := 0; i < level && limiter.parent != nil; i++ {
+		limiter = limiter.parent
+	}
+	return limiter
+}
+
+/**
+ * Levels
+ *
+ * The stores count every level like the SlidingWindowCounter strategy, in
+ * the keys the level uses on its own
+ */
+
+// levels returns the limit and every limit above it, starting w/ the limit
+func (l *Limit) levels() []*Limit {
+	var levels []*Limit
+	for level := l; level != nil; level = level.Parent {
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// counterRules returns the rules of the limit, which is a single one for a
+// SlidingWindowCounter
+func (l *Limit) counterRules() []Rule {
+	if len(l.Rules) > 0 {
+		return l.Rules
+	}
+	return []Rule{{MaxRequests: l.MaxRequests, Interval: time.Duration(l.TimeInterval) * time.Millisecond}}
+}
+
+// counterToken returns the token used for the counters of the limit
+func (l *Limit) counterToken() string {
+	if len(l.Rules) > 0 {
+		return l.compositeToken()
+	}
+	return l.slidingCounterToken()
+}
+
+// counterPrefix returns the prefix of the counters of the rule, which is
+// empty for a SlidingWindowCounter
+func (l *Limit) counterPrefix(rule Rule) string {
+	if len(l.Rules) > 0 {
+		return fmt.Sprintf("%d:", rule.interval())
+	}
+	return ""
+}
+
+// hierarchyArgs returns the keys and arguments of the hierarchyScript
+func (l *Limit) hierarchyArgs(n int, now int64) []interface{} {
+	levels := l.levels()
+	args := []interface{}{len(levels)}
+	for _, level := range levels {
+		args = append(args, level.counterToken())
+	}
+
+	args = append(args, n, now)
+	for _, level := range levels {
+		rules := level.counterRules()
+		args = append(args, len(rules))
+		for _, rule := range rules {
+			args = append(args, rule.MaxRequests, rule.interval(), level.counterPrefix(rule))
+		}
+	}
+	return args
+}
+
+// counterRefundArgs returns the keys and arguments of the
+// counterRefundScript, to give back n requests counted at the time at
+func (l *Limit) counterRefundArgs(at int64, n int, now int64) []interface{} {
+	args := []interface{}{l.counterToken(), at, n, now}
+	for _, rule := range l.counterRules() {
+		args = append(args, rule.interval(), l.counterPrefix(rule))
+	}
+	return args
+}
+
+// hierarchyRefundArgs returns the keys and arguments of the
+// hierarchyRefundScript, to give back n requests counted at the time at
+func (l *Limit) hierarchyRefundArgs(at int64, n int, now int64) []interface{} {
+	levels := l.levels()
+	args := []interface{}{len(levels)}
+	for _, level := range levels {
+		args = append(args, level.counterToken())
+	}
+
+	args = append(args, at, n, now)
+	for _, level := range levels {
+		rules := level.counterRules()
+		args = append(args, len(rules))
+		for _, rule := range rules {
+			args = append(args, rule.interval(), level.counterPrefix(rule))
+		}
+	}
+	return args
+}
@@ -0,0 +1,209 @@
+package funnel
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+import (
+	"github.com/garyburd/redigo/redis"
+	. "gopkg.in/check.v1"
+)
+
+// HierarchyTest nests the limiters of tenants within a global one, on redis,
+// through its own pool, and on a MemoryStore
+type HierarchyTest struct{}
+
+var _ = Suite(&HierarchyTest{})
+
+// newTenantLimiters creates a global limiter of 3 requests a minute, and the
+// limiters of 2 tenants of 2 requests a minute nested within it, all on the
+// default strategy
+func newTenantLimiters(c *C, store Store) (*RateLimiter, *RateLimiter, *RateLimiter) {
+	global, err := New("globalToken", 3, time.Minute, WithStore(store))
+	c.Assert(err, IsNil)
+
+	var tenants []*RateLimiter
+	for _, token := range []string{"tenantAToken", "tenantBToken"} {
+		tenant, err := New(token, 2, time.Minute, WithStore(store),
+			WithParent(global), WithRetries(1), WithRetryDelay(time.Millisecond))
+		c.Assert(err, IsNil)
+		tenants = append(tenants, tenant)
+	}
+	return global, tenants[0], tenants[1]
+}
+
+// clearHierarchy removes the keys of every level from redis
+func clearHierarchy(c *C, pool *redis.Pool, limiters ...*RateLimiter) {
+	for _, limiter := range limiters {
+		clearStatusLimiter(c, pool, limiter.limit())
+	}
+}
+
+// assertDeniedBy checks that the request is turned down by the level w/ the
+// key, whether it waits or not
+func assertDeniedBy(c *C, rateLimiter *RateLimiter, key string) {
+	err := rateLimiter.EnterContext(context.Background())
+	var limitErr *LimitError
+	c.Assert(errors.As(err, &limitErr), Equals, true)
+	c.Assert(limitErr.Key, Equals, key)
+
+	admitted, limitErr, err := rateLimiter.TryEnterWithLimit()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(limitErr, NotNil)
+	c.Assert(limitErr.Key, Equals, key)
+	c.Assert(limitErr.RetryAfter > 0, Equals, true)
+}
+
+// assertHierarchy checks that the tenants are held back by their own limit
+// and by the global one
+func assertHierarchy(c *C, global *RateLimiter, tenantA *RateLimiter, tenantB *RateLimiter) {
+	assertAdmits(c, tenantA, true)
+	assertAdmits(c, tenantA, true)
+	assertDeniedBy(c, tenantA, "tenantAToken")
+
+	assertAdmits(c, tenantB, true)
+	assertDeniedBy(c, tenantB, "globalToken")
+
+	// The tenant that was turned down by the global limit kept its room
+	status, err := tenantB.Status(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(status.Used, Equals, 1)
+
+	status, err = global.Status(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(status.Used, Equals, 3)
+}
+
+//---------
+// Test Hierarchy
+//---------
+
+// TestHierarchyOnRedis tests nested limiters on redis
+func (h *HierarchyTest) TestHierarchyOnRedis(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	global, tenantA, tenantB := newTenantLimiters(c, NewRedisStore(pool))
+	clearHierarchy(c, pool, global, tenantA, tenantB)
+	assertHierarchy(c, global, tenantA, tenantB)
+}
+
+// TestHierarchyWithPool tests that limiters created w/ the same pool, each
+// w/ a store of its own, can be nested
+func (h *HierarchyTest) TestHierarchyWithPool(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	global, err := NewLimiterWithPool(pool, &RateLimitInfo{Token: "globalToken", MaxRequests: 3, TimeInterval: 60000, Strategy: SlidingWindowCounter})
+	c.Assert(err, IsNil)
+	var tenants []*RateLimiter
+	for _, token := range []string{"tenantAToken", "tenantBToken"} {
+		tenant, err := NewLimiterWithPool(pool, &RateLimitInfo{Token: token, MaxRequests: 2, TimeInterval: 60000, Strategy: SlidingWindowCounter},
+			WithParent(global), WithRetries(1), WithRetryDelay(time.Millisecond))
+		c.Assert(err, IsNil)
+		tenants = append(tenants, tenant)
+	}
+
+	clearHierarchy(c, pool, global, tenants[0], tenants[1])
+	assertHierarchy(c, global, tenants[0], tenants[1])
+
+	_, err = NewLimiterWithPool(newTestPool(0), &RateLimitInfo{Token: "tenantToken", MaxRequests: 2, TimeInterval: 60000, Strategy: SlidingWindowCounter},
+		WithParent(global))
+	c.Assert(err, ErrorMatches, ".*must share the store.*")
+}
+
+// TestHierarchyInMemory tests nested limiters on a MemoryStore
+func (h *HierarchyTest) TestHierarchyInMemory(c *C) {
+	global, tenantA, tenantB := newTenantLimiters(c, NewMemoryStore())
+	assertHierarchy(c, global, tenantA, tenantB)
+}
+
+// TestHierarchyOfCompositeLimiters tests that a composite limiter can be
+// nested, and nest others
+func (h *HierarchyTest) TestHierarchyOfCompositeLimiters(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	for _, store := range []Store{NewRedisStore(pool), NewMemoryStore()} {
+		global, err := NewCompositeLimiter("globalCompositeToken", []Rule{
+			{MaxRequests: 10, Interval: time.Second},
+			{MaxRequests: 2, Interval: time.Minute},
+		}, WithStore(store))
+		c.Assert(err, IsNil)
+		tenant, err := New("tenantCompositeToken", 5, time.Minute, WithStore(store), WithStrategy(SlidingWindowCounter),
+			WithParent(global), WithRetries(1), WithRetryDelay(time.Millisecond))
+		c.Assert(err, IsNil)
+		clearHierarchy(c, pool, global, tenant)
+
+		assertAdmits(c, tenant, true)
+		assertAdmits(c, tenant, true)
+		assertDeniedBy(c, tenant, "globalCompositeToken")
+	}
+}
+
+// TestHierarchyRefund tests that a refund gives the room back in every level,
+// but only when the limiter itself got it back
+func (h *HierarchyTest) TestHierarchyRefund(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	for _, store := range []Store{NewRedisStore(pool), NewMemoryStore()} {
+		global, tenantA, tenantB := newTenantLimiters(c, store)
+		clearHierarchy(c, pool, global, tenantA, tenantB)
+
+		admission, err := tenantA.TryAdmitN(2)
+		c.Assert(err, IsNil)
+		c.Assert(admission, NotNil)
+		assertAdmits(c, tenantB, true)
+		assertAdmits(c, tenantB, false)
+
+		// Room the tenant never took isn't given back by the global limiter
+		// either
+		now := tenantB.now()
+		refunded, err := store.Refund(tenantB.limit(), now, "", 2, now)
+		c.Assert(err, IsNil)
+		c.Assert(refunded, Equals, false)
+		assertAdmits(c, tenantB, false)
+
+		refunded, err = admission.Refund()
+		c.Assert(err, IsNil)
+		c.Assert(refunded, Equals, true)
+		assertAdmits(c, tenantB, true)
+		assertAdmits(c, tenantA, true)
+		assertAdmits(c, global, false)
+	}
+}
+
+// TestHierarchyValidation tests that levels that can't take room together
+// are turned down
+func (h *HierarchyTest) TestHierarchyValidation(c *C) {
+	store := NewMemoryStore()
+	global, err := New("globalToken", 3, time.Minute, WithStore(store), WithStrategy(GCRA))
+	c.Assert(err, IsNil)
+	_, err = New("tenantToken", 2, time.Minute, WithStore(store), WithParent(global))
+	c.Assert(err, ErrorMatches, ".*not the GCRA one of globalToken.*")
+
+	_, err = New("tenantToken", 2, time.Minute, WithStore(store), WithStrategy(SlidingLog), WithParent(global))
+	c.Assert(err, ErrorMatches, ".*not the SlidingLog one of tenantToken.*")
+
+	global, err = New("globalToken", 3, time.Minute, WithStore(store), WithStrategy(SlidingWindowCounter))
+	c.Assert(err, IsNil)
+	_, err = New("tenantToken", 2, time.Minute, WithStore(NewMemoryStore()), WithStrategy(SlidingWindowCounter), WithParent(global))
+	c.Assert(err, ErrorMatches, ".*must share the store.*")
+
+	// W/out a store of its own, the limiter shares the one of its parent
+	tenant, err := New("tenantToken", 2, time.Minute, WithStrategy(SlidingWindowCounter), WithParent(global))
+	c.Assert(err, IsNil)
+	c.Assert(tenant.store, Equals, store)
+
+	_, err = New("tenantToken", 2, time.Minute, WithStore(store), WithParent(nil))
+	c.Assert(err, ErrorMatches, ".*parent can't be nil.*")
+
+	// A request has to fit in every level
+	tenant, err = New("tenantToken", 5, time.Minute, WithStore(store), WithStrategy(SlidingWindowCounter), WithParent(global))
+	c.Assert(err, IsNil)
+	c.Assert(tenant.EnterN(4), ErrorMatches, ".*max of 3 in the parent globalToken.*")
+}
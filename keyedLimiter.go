@@ -0,0 +1,259 @@
+package funnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// overrideTTL is the time (in ms) the loaded override of a key is kept
+	// for, before it is loaded again
+	overrideTTL = 5 * 60 * 1000
+
+	// maxOverrides is the most loaded overrides kept at once
+	maxOverrides = 10000
+)
+
+// Overrides loads the limit of a key that differs from the template of a
+// KeyedLimiter, such as the plan of a tenant. It returns nil when the key
+// uses the template. The Token of the limit is ignored
+type Overrides func(key string) (*RateLimitInfo, error)
+
+// KeyedLimiter limits each key, such as a user, a tenant or an IP, on its
+// own, w/ limiters built from a single template. Nothing is kept for a key
+// until it is entered, and the state of each key lives in the store under
+// the token of the template followed by the key
+type KeyedLimiter struct {
+	// base is the limiter of the template, which the limiter of each key is
+	// derived from
+	base *RateLimiter
+
+	// token is the token of the template
+	token string
+
+	// opts are the options applied to the limiters of overridden keys
+	opts []Option
+
+	// overrides loads the limit of a key that differs from the template
+	overrides Overrides
+
+	// mutex guards the loaded limiters and the loads under way
+	mutex sync.Mutex
+
+	// loaded are the overrides loaded for each key, including the keys that
+	// use the template
+	loaded map[string]*loadedLimiter
+
+	// loading are the loads under way, so that a key is only loaded once at
+	// a time however many requests of it arrive
+	loading map[string]*keyLoad
+}
+
+// loadedLimiter is the loaded override of a key
+type loadedLimiter struct {
+	// limiter is the limiter built from the override, or nil when the key
+	// uses the template
+	limiter *RateLimiter
+
+	// expiry is the time (in ms) the override is loaded again after
+	expiry int64
+}
+
+// keyLoad is the load of the override of a key that is under way
+type keyLoad struct {
+	// done is closed once the load is over
+	done chan struct{}
+
+	// limiter is the limiter of the key, or nil when it uses the template
+	limiter *RateLimiter
+
+	// err is the error of the load
+	err error
+}
+
+// NewKeyedLimiter is a factory method for creating a limiter for any key,
+// w/ the template as the limit of each. The overrides may be nil when every
+// key uses the template. An override is loaded once for concurrent requests
+// of the key, and is kept for 5 minutes, for up to 10000 keys, as is the
+// finding that a key uses the template. The options apply to the limiter of
+// every key
+func NewKeyedLimiter(template *RateLimitInfo, overrides Overrides, opts ...Option) (*KeyedLimiter, error) {
+	if template.Token == "" {
+		return nil, errors.New("Unable to create the keyed limiter. The template needs a token to keep the keys under")
+	}
+
+	base, err := newLimiter(nil, template, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := base.setDefaultStore(); err != nil {
+		return nil, err
+	}
+	if err := base.setup(template); err != nil {
+		return nil, err
+	}
+
+	return &KeyedLimiter{
+		base:      base,
+		token:     template.Token,
+		opts:      opts,
+		overrides: overrides,
+		loaded:    make(map[string]*loadedLimiter),
+		loading:   make(map[string]*keyLoad),
+	}, nil
+}
+
+// Enter attempts to enter the request of the key, like EnterContext
+func (k *KeyedLimiter) Enter(ctx context.Context, key string) error {
+	return k.EnterN(ctx, key, 1)
+}
+
+// EnterN attempts to enter a request of the key that costs n units of the
+// max requests, like EnterNContext
+func (k *KeyedLimiter) EnterN(ctx context.Context, key string, n int) error {
+	limiter, err := k.Limiter(key)
+	if err != nil {
+		return err
+	}
+	return limiter.EnterNContext(ctx, n)
+}
+
+// TryEnter makes a single attempt to enter the request of the key w/out
+// blocking, like TryEnter
+func (k *KeyedLimiter) TryEnter(key string) (bool, error) {
+	limiter, err := k.Limiter(key)
+	if err != nil {
+		return false, err
+	}
+	return limiter.TryEnter()
+}
+
+// Limiter returns the limiter of the key, for anything else that a
+// RateLimiter does, such as reservations. The limiters of keys that use the
+// template are cheap to derive, and aren't kept once they are dropped
+func (k *KeyedLimiter) Limiter(key string) (*RateLimiter, error) {
+	if key == "" {
+		return nil, errors.New("Unable to limit the key. The key can't be empty")
+	}
+	if strings.ContainsAny(key, "{}") {
+		return nil, errors.New("Unable to limit the key. The key can't contain braces, they would break the hash tag of the keys")
+	}
+
+	if k.overrides == nil {
+		return k.base.withToken(k.keyToken(key)), nil
+	}
+
+	limiter, err := k.override(key)
+	if err != nil {
+		return nil, err
+	}
+	if limiter == nil {
+		return k.base.withToken(k.keyToken(key)), nil
+	}
+	return limiter, nil
+}
+
+// override returns the limiter of the overridden key, or nil when the key uses
+// the template. A request of the key that arrives while its override is
+// being loaded waits for that load
+func (k *KeyedLimiter) override(key string) (*RateLimiter, error) {
+	now := k.base.now()
+	k.mutex.Lock()
+	if loaded, ok := k.loaded[key]; ok && now < loaded.expiry {
+		k.mutex.Unlock()
+		return loaded.limiter, nil
+	}
+	if load, ok := k.loading[key]; ok {
+		k.mutex.Unlock()
+		<-load.done
+		return load.limiter, load.err
+	}
+
+	load := &keyLoad{done: make(chan struct{})}
+	k.loading[key] = load
+	k.mutex.Unlock()
+
+	load.limiter, load.err = k.load(key)
+
+	k.mutex.Lock()
+	delete(k.loading, key)
+	delete(k.loaded, key)
+	if load.err == nil {
+		k.keep(key, load.limiter, now)
+	}
+	k.mutex.Unlock()
+	close(load.done)
+	return load.limiter, load.err
+}
+
+// keep keeps the limiter of the key, which is nil when the key uses the
+// template, making room for it first when there are too many. The mutex must
+// be held
+func (k *KeyedLimiter) keep(key string, limiter *RateLimiter, now int64) {
+	if len(k.loaded) >= maxOverrides {
+		// Drop the expired limiters, or else the one that expires first
+		oldest := ""
+		for loadedKey, loaded := range k.loaded {
+			if now >= loaded.expiry {
+				delete(k.loaded, loadedKey)
+			} else if oldest == "" || loaded.expiry < k.loaded[oldest].expiry {
+				oldest = loadedKey
+			}
+		}
+		if len(k.loaded) >= maxOverrides {
+			delete(k.loaded, oldest)
+		}
+	}
+	k.loaded[key] = &loadedLimiter{limiter: limiter, expiry: now + overrideTTL}
+}
+
+// Forget drops the override loaded for the key, or the finding that it uses
+// the template, so that it is loaded again the next time the key is entered.
+// The state of the key in the store is left as is
+func (k *KeyedLimiter) Forget(key string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	delete(k.loaded, key)
+}
+
+// load loads the override of the key, and creates its limiter. The limiter
+// is nil when the key uses the template
+func (k *KeyedLimiter) load(key string) (*RateLimiter, error) {
+	info, err := k.overrides(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load the limit of the key %q. %v", key, err)
+	}
+	if info == nil {
+		return nil, nil
+	}
+
+	override := *info
+	override.Token = k.keyToken(key)
+	limiter, err := newLimiter(k.base.store, &override, k.opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := limiter.setup(&override); err != nil {
+		return nil, err
+	}
+
+	// Every key shares the store, and so whether it is available
+	limiter.degradation = k.base.degradation
+	return limiter, nil
+}
+
+// keyToken returns the token the state of the key is kept under
+func (k *KeyedLimiter) keyToken(key string) string {
+	return k.token + ":" + key
+}
+
+// withToken returns a copy of the limiter that keeps its state under the
+// token
+func (r *RateLimiter) withToken(token string) *RateLimiter {
+	limiter := *r
+	limiter.token = token + limiterTokenSuffix
+	return &limiter
+}
@@ -0,0 +1,242 @@
+package funnel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+// KeyedLimiterTest limits keys w/ limiters built from a template
+type KeyedLimiterTest struct{}
+
+var _ = Suite(&KeyedLimiterTest{})
+
+// keyedTemplate admits 2 requests a minute for each key
+var keyedTemplate = &RateLimitInfo{
+	Token:        "keyedToken",
+	MaxRequests:  2,
+	TimeInterval: 60000,
+}
+
+// assertKeyAdmits checks whether the next request of the key is admitted
+func assertKeyAdmits(c *C, limiter *KeyedLimiter, key string, expected bool) {
+	admitted, err := limiter.TryEnter(key)
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, expected, Commentf("%s", key))
+}
+
+//---------
+// Test Keys
+//---------
+
+// TestKeysAreLimitedOnTheirOwn tests that each key has its own room
+func (k *KeyedLimiterTest) TestKeysAreLimitedOnTheirOwn(c *C) {
+	limiter, err := NewKeyedLimiter(keyedTemplate, nil, WithStore(NewMemoryStore()))
+	c.Assert(err, IsNil)
+
+	c.Assert(limiter.Enter(context.Background(), "alice"), IsNil)
+	assertKeyAdmits(c, limiter, "alice", true)
+	assertKeyAdmits(c, limiter, "alice", false)
+	assertKeyAdmits(c, limiter, "bob", true)
+}
+
+// TestKeysOnRedis tests that the state of each key is kept in redis under
+// the token of the template and the key
+func (k *KeyedLimiterTest) TestKeysOnRedis(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	limiter, err := NewKeyedLimiter(keyedTemplate, nil, WithStore(NewRedisStore(pool)))
+	c.Assert(err, IsNil)
+
+	alice, err := limiter.Limiter("alice")
+	c.Assert(err, IsNil)
+	c.Assert(alice.key(), Equals, "keyedToken:alice")
+	clearStatusLimiter(c, pool, alice.limit())
+
+	assertKeyAdmits(c, limiter, "alice", true)
+	assertKeyAdmits(c, limiter, "alice", true)
+	assertKeyAdmits(c, limiter, "alice", false)
+
+	// Another process w/ the same template shares the state of the key
+	other, err := NewKeyedLimiter(keyedTemplate, nil, WithStore(NewRedisStore(pool)))
+	c.Assert(err, IsNil)
+	assertKeyAdmits(c, other, "alice", false)
+
+	// As does a limiter created for the token of the key
+	single, err := New("keyedToken:alice", 2, time.Minute, WithStore(NewRedisStore(pool)))
+	c.Assert(err, IsNil)
+	assertAdmits(c, single, false)
+}
+
+// TestInvalidKeys tests that keys that would break the keys in the store
+// are turned down
+func (k *KeyedLimiterTest) TestInvalidKeys(c *C) {
+	limiter, err := NewKeyedLimiter(keyedTemplate, nil, WithStore(NewMemoryStore()))
+	c.Assert(err, IsNil)
+
+	c.Assert(limiter.Enter(context.Background(), ""), ErrorMatches, ".*can't be empty.*")
+	c.Assert(limiter.Enter(context.Background(), "{alice}"), ErrorMatches, ".*braces.*")
+
+	_, err = NewKeyedLimiter(&RateLimitInfo{MaxRequests: 1, TimeInterval: 1000}, nil, WithStore(NewMemoryStore()))
+	c.Assert(err, ErrorMatches, ".*needs a token.*")
+}
+
+//---------
+// Test Overrides
+//---------
+
+// TestOverrides tests that an overridden key gets its own limit, loaded
+// once, while the other keys use the template
+func (k *KeyedLimiterTest) TestOverrides(c *C) {
+	loads := 0
+	limiter, err := NewKeyedLimiter(keyedTemplate, func(key string) (*RateLimitInfo, error) {
+		loads++
+		if key == "premium" {
+			return &RateLimitInfo{MaxRequests: 4, TimeInterval: 60000}, nil
+		}
+		return nil, nil
+	}, WithStore(NewMemoryStore()))
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 4; i++ {
+		assertKeyAdmits(c, limiter, "premium", true)
+	}
+	assertKeyAdmits(c, limiter, "premium", false)
+
+	assertKeyAdmits(c, limiter, "basic", true)
+	assertKeyAdmits(c, limiter, "basic", true)
+	assertKeyAdmits(c, limiter, "basic", false)
+	c.Assert(loads, Equals, 2)
+
+	// A forgotten key is loaded again, but keeps its state
+	limiter.Forget("premium")
+	assertKeyAdmits(c, limiter, "premium", false)
+	c.Assert(loads, Equals, 3)
+}
+
+// TestTemplateKeysAreKept tests that finding that a key uses the template is
+// kept as well, so that repeated requests don't load it again
+func (k *KeyedLimiterTest) TestTemplateKeysAreKept(c *C) {
+	loads := 0
+	limiter, err := NewKeyedLimiter(&RateLimitInfo{Token: "keyedTemplateToken", MaxRequests: 100, TimeInterval: 60000},
+		func(key string) (*RateLimitInfo, error) {
+			loads++
+			return nil, nil
+		}, WithStore(NewMemoryStore()))
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 10; i++ {
+		c.Assert(limiter.Enter(context.Background(), "basic"), IsNil)
+	}
+	c.Assert(loads, Equals, 1)
+
+	limiter.Forget("basic")
+	c.Assert(limiter.Enter(context.Background(), "basic"), IsNil)
+	c.Assert(loads, Equals, 2)
+}
+
+// TestOverrideExpires tests that an override is loaded again once it was
+// kept for its ttl
+func (k *KeyedLimiterTest) TestOverrideExpires(c *C) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	loads := 0
+	limiter, err := NewKeyedLimiter(keyedTemplate, func(key string) (*RateLimitInfo, error) {
+		loads++
+		return &RateLimitInfo{MaxRequests: 4, TimeInterval: 60000}, nil
+	}, WithStore(NewMemoryStore()), WithClock(clock))
+	c.Assert(err, IsNil)
+
+	assertKeyAdmits(c, limiter, "premium", true)
+	assertKeyAdmits(c, limiter, "premium", true)
+	c.Assert(loads, Equals, 1)
+
+	clock.now = clock.now.Add(overrideTTL * time.Millisecond)
+	assertKeyAdmits(c, limiter, "premium", true)
+	c.Assert(loads, Equals, 2)
+}
+
+// TestConcurrentLoads tests that the requests of a key that arrive while its
+// override is being loaded wait for that load, rather than load it again
+func (k *KeyedLimiterTest) TestConcurrentLoads(c *C) {
+	var mutex sync.Mutex
+	loads := 0
+	release := make(chan struct{})
+	limiter, err := NewKeyedLimiter(keyedTemplate, func(key string) (*RateLimitInfo, error) {
+		mutex.Lock()
+		loads++
+		mutex.Unlock()
+		<-release
+		return &RateLimitInfo{MaxRequests: 10, TimeInterval: 60000}, nil
+	}, WithStore(NewMemoryStore()))
+	c.Assert(err, IsNil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assertKeyAdmits(c, limiter, "premium", true)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	c.Assert(loads, Equals, 1)
+}
+
+// TestOverrideWithStrategy tests that an override can use another strategy
+// than the template
+func (k *KeyedLimiterTest) TestOverrideWithStrategy(c *C) {
+	limiter, err := NewKeyedLimiter(keyedTemplate, func(key string) (*RateLimitInfo, error) {
+		return &RateLimitInfo{Strategy: GCRA, Rate: 10, Burst: 3}, nil
+	}, WithStore(NewMemoryStore()))
+	c.Assert(err, IsNil)
+
+	gcra, err := limiter.Limiter("alice")
+	c.Assert(err, IsNil)
+	c.Assert(gcra.strategy, Equals, GCRA)
+	c.Assert(gcra.burst, Equals, 3)
+	c.Assert(gcra.key(), Equals, "keyedToken:alice")
+}
+
+// TestOverrideFailure tests that a failure to load an override is returned,
+// and that the override is loaded again on the next request
+func (k *KeyedLimiterTest) TestOverrideFailure(c *C) {
+	fail := true
+	limiter, err := NewKeyedLimiter(keyedTemplate, func(key string) (*RateLimitInfo, error) {
+		if fail {
+			return nil, errors.New("Plans are unavailable")
+		}
+		return nil, nil
+	}, WithStore(NewMemoryStore()))
+	c.Assert(err, IsNil)
+
+	_, err = limiter.TryEnter("alice")
+	c.Assert(err, ErrorMatches, ".*Plans are unavailable.*")
+
+	fail = false
+	assertKeyAdmits(c, limiter, "alice", true)
+}
+
+// TestKeysShareTheFailurePolicy tests that once the store fails for a key,
+// every key admits requests through the failure policy
+func (k *KeyedLimiterTest) TestKeysShareTheFailurePolicy(c *C) {
+	store := &flakyStore{MemoryStore: NewMemoryStore(), down: 1}
+	limiter, err := NewKeyedLimiter(keyedTemplate, func(key string) (*RateLimitInfo, error) {
+		return &RateLimitInfo{MaxRequests: 1, TimeInterval: 60000}, nil
+	}, WithStore(store), WithFailurePolicy(FailOpen))
+	c.Assert(err, IsNil)
+
+	assertKeyAdmits(c, limiter, "alice", true)
+	bob, err := limiter.Limiter("bob")
+	c.Assert(err, IsNil)
+	c.Assert(bob.Mode(), Equals, ModeDegraded)
+	assertKeyAdmits(c, limiter, "bob", true)
+}
@@ -0,0 +1,119 @@
+package funnel
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Logger receives the events of the limiters, such as the errors of the
+// store. Limiters don't log anything unless they're given a Logger
+type Logger interface {
+	// Debug logs an event that is only of interest when tracing the limiter,
+	// such as a request being turned down before a retry
+	Debug(msg string, fields Fields)
+
+	// Error logs an error the limiter recovered from, such as the store
+	// failing on an attempt that is then retried
+	Error(msg string, fields Fields)
+}
+
+// Fields are the structured fields of a log entry. Fields that don't apply
+// to an entry are left zero
+type Fields struct {
+	// Token is the token of the limiter
+	Token string
+
+	// Attempt is the attempt the entry is about, counted from 1
+	Attempt int
+
+	// Wait is the time waited before the next attempt
+	Wait time.Duration
+
+	// Err is the error that occurred
+	Err error
+}
+
+// WithLogger sets the logger the limiter logs its events to. Defaults to a
+// logger that drops them
+func WithLogger(logger Logger) Option {
+	return func(r *RateLimiter) error {
+		r.logger = loggerOrNop(logger)
+		return nil
+	}
+}
+
+// loggerOrNop returns the logger, or one that drops every entry when it is
+// nil
+func loggerOrNop(logger Logger) Logger {
+	if logger == nil {
+		return nopLogger{}
+	}
+	return logger
+}
+
+/**
+ * No-op Logger
+ */
+
+// nopLogger drops every entry
+type nopLogger struct{}
+
+// Debug drops the entry
+func (nopLogger) Debug(msg string, fields Fields) {}
+
+// Error drops the entry
+func (nopLogger) Error(msg string, fields Fields) {}
+
+/**
+ * slog Logger
+ */
+
+// slogLogger logs the entries to a slog.Logger
+type slogLogger struct {
+	// logger is the slog.Logger the entries are logged to
+	logger *slog.Logger
+}
+
+// NewSlogLogger is a factory method for creating a Logger that logs to a
+// slog.Logger, w/ each of the fields that apply as an attribute. A nil
+// logger logs to slog.Default()
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &slogLogger{logger: logger}
+}
+
+// Debug logs the entry at the debug level
+func (l *slogLogger) Debug(msg string, fields Fields) {
+	l.log(slog.LevelDebug, msg, fields)
+}
+
+// Error logs the entry at the error level
+func (l *slogLogger) Error(msg string, fields Fields) {
+	l.log(slog.LevelError, msg, fields)
+}
+
+// log logs the entry w/ the fields that apply as attributes
+func (l *slogLogger) log(level slog.Level, msg string, fields Fields) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := make([]slog.Attr, 0, 4)
+	if fields.Token != "" {
+		attrs = append(attrs, slog.String("token", fields.Token))
+	}
+	if fields.Attempt != 0 {
+		attrs = append(attrs, slog.Int("attempt", fields.Attempt))
+	}
+	if fields.Wait != 0 {
+		attrs = append(attrs, slog.Duration("wait", fields.Wait))
+	}
+	if fields.Err != nil {
+		attrs = append(attrs, slog.Any("error", fields.Err))
+	}
+	l.logger.LogAttrs(ctx, level, msg, attrs...)
+}
@@ -0,0 +1,129 @@
+package funnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+// LoggerTest checks what the limiters log, w/out redis
+type LoggerTest struct{}
+
+var _ = Suite(&LoggerTest{})
+
+// logEntry is an entry recorded by a recordingLogger
+type logEntry struct {
+	// level is "debug" or "error"
+	level string
+
+	// msg is the message of the entry
+	msg string
+
+	// fields are the fields of the entry
+	fields Fields
+}
+
+// recordingLogger records every entry
+type recordingLogger struct {
+	// mutex guards the entries
+	mutex sync.Mutex
+
+	// entries are the entries in the order they were logged
+	entries []logEntry
+}
+
+func (l *recordingLogger) Debug(msg string, fields Fields) {
+	l.record("debug", msg, fields)
+}
+
+func (l *recordingLogger) Error(msg string, fields Fields) {
+	l.record("error", msg, fields)
+}
+
+func (l *recordingLogger) record(level string, msg string, fields Fields) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, logEntry{level: level, msg: msg, fields: fields})
+}
+
+//---------
+// Test Logging
+//---------
+
+// TestLogsStoreErrors tests that each failed attempt is logged as an error
+// w/ its fields
+func (l *LoggerTest) TestLogsStoreErrors(c *C) {
+	logger := &recordingLogger{}
+	rateLimiter, _ := newFlakyLimiter(c, 10, WithRetries(2), WithRetryDelay(time.Millisecond), WithLogger(logger))
+
+	err := rateLimiter.Enter()
+	c.Assert(errors.Is(err, ErrBackendUnavailable), Equals, true)
+
+	c.Assert(logger.entries, HasLen, 2)
+	for i, entry := range logger.entries {
+		c.Assert(entry.level, Equals, "error")
+		c.Assert(entry.fields.Token, Equals, "flakyToken")
+		c.Assert(entry.fields.Attempt, Equals, i+1)
+		c.Assert(entry.fields.Wait >= time.Millisecond, Equals, true)
+		c.Assert(errors.Is(entry.fields.Err, ErrBackendUnavailable), Equals, true)
+	}
+}
+
+// TestLogsRetries tests that turned down attempts are logged at the debug
+// level w/out an error
+func (l *LoggerTest) TestLogsRetries(c *C) {
+	logger := &recordingLogger{}
+	rateLimiter, err := NewLimiterWithStore(NewMemoryStore(), &RateLimitInfo{
+		Token:        "loggedToken",
+		MaxRequests:  1,
+		TimeInterval: 1000,
+	}, WithRetries(1), WithRetryDelay(time.Millisecond), WithLogger(logger))
+	c.Assert(err, IsNil)
+
+	c.Assert(rateLimiter.Enter(), IsNil)
+	c.Assert(logger.entries, HasLen, 0)
+
+	c.Assert(errors.Is(rateLimiter.Enter(), ErrLimitExceeded), Equals, true)
+	c.Assert(logger.entries, HasLen, 1)
+	c.Assert(logger.entries[0].level, Equals, "debug")
+	c.Assert(logger.entries[0].fields.Attempt, Equals, 1)
+	c.Assert(logger.entries[0].fields.Err, IsNil)
+}
+
+// TestSlogLogger tests that the slog adapter logs the fields as attributes,
+// and leaves out the ones that don't apply
+func (l *LoggerTest) TestSlogLogger(c *C) {
+	var buffer bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	logger.Error("Unable to reach the store", Fields{
+		Token:   "slogToken",
+		Attempt: 2,
+		Wait:    50 * time.Millisecond,
+		Err:     errors.New("Store is down"),
+	})
+
+	var entry map[string]interface{}
+	c.Assert(json.Unmarshal(buffer.Bytes(), &entry), IsNil)
+	c.Assert(entry["level"], Equals, "ERROR")
+	c.Assert(entry["msg"], Equals, "Unable to reach the store")
+	c.Assert(entry["token"], Equals, "slogToken")
+	c.Assert(entry["attempt"], Equals, float64(2))
+	c.Assert(entry["wait"], Equals, float64(50*time.Millisecond))
+	c.Assert(entry["error"], Equals, "Store is down")
+
+	buffer.Reset()
+	logger.Debug("Rate limiter is full", Fields{Token: "slogToken"})
+	entry = nil
+	c.Assert(json.Unmarshal(buffer.Bytes(), &entry), IsNil)
+	c.Assert(entry["level"], Equals, "DEBUG")
+	_, hasError := entry["error"]
+	c.Assert(hasError, Equals, false)
+}
@@ -0,0 +1,807 @@
+package funnel
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStore keeps the state of rate limiters in the memory of the process.
+// It follows the same algorithms as the RedisStore, but only limits the
+// requests of a single process. It suits tests, local development and single
+// binary deployments that have no redis
+type MemoryStore struct {
+	// mutex guards the states
+	mutex sync.Mutex
+
+	// states holds the state of each limiter by its token
+	states map[string]*memoryState
+
+	// nextSweep is the time (in ms) the states that hold nothing anymore are
+	// dropped at next
+	nextSweep int64
+}
+
+// memorySweepInterval is the time (in ms) between the sweeps of the states
+// of a MemoryStore
+const memorySweepInterval = 1000
+
+// memoryState is the state of a single limiter, the counterpart to the keys
+// a RedisStore keeps for it
+type memoryState struct {
+	// count is the amount of requests in the current FixedWindow
+	count int
+
+	// windowEnd is the time (in ms) the current FixedWindow expires at
+	windowEnd int64
+
+	// admitted is the amount of requests each take has in the current
+	// FixedWindow, by the id of the take
+	admitted map[string]int
+
+	// reserved is the amount of requests reserved in upcoming FixedWindows,
+	// by the start (in ms) of the window
+	reserved map[int64]int
+
+	// log is the SlidingLog, in the order of the time of its entries
+	log []memoryEntry
+
+	// counters is the counter of each SlidingWindowCounter window, by the
+	// index of the window
+	counters map[int64]int
+
+	// ruleCounters are the counters of each rule of a composite limiter, by
+	// the interval (in ms) of the rule and the index of the window
+	ruleCounters map[int64]map[int64]int
+
+	// tat is the theoretical arrival time (in ms) of the next GCRA request
+	tat float64
+
+	// nextSlot is the time (in ms) of the next free LeakyBucket slot
+	nextSlot float64
+
+	// tickets is the last ticket handed out by the fair queue
+	tickets int64
+
+	// queue is the time (in ms) each ticket waiting in the fair queue is
+	// held until, by the ticket
+	queue map[int64]int64
+
+	// expiry is the time (in ms) the state holds nothing after, when it is
+	// dropped like the keys of a RedisStore expire
+	expiry int64
+}
+
+// memoryEntry is an entry in the SlidingLog of a memoryState
+type memoryEntry struct {
+	// at is the time (in ms) the request may proceed
+	at int64
+
+	// member identifies the entry
+	member string
+}
+
+// NewMemoryStore is a factory method for creating an in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: make(map[string]*memoryState)}
+}
+
+// Take takes room for n requests in the limiter
+func (s *MemoryStore) Take(limit *Limit, n int, now int64, wait int64) (TakeResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sweep(now)
+	if limit.Parent != nil {
+		return s.takeHierarchy(limit, n, now), nil
+	}
+
+	state := s.state(limit.KeyPrefix + limit.Token)
+	result := state.take(limit, n, now, wait)
+	state.expiry = state.heldUntil(limit)
+	return result, nil
+}
+
+// take takes room for n requests in the state w/ the algorithm of the limit
+func (m *memoryState) take(limit *Limit, n int, now int64, wait int64) TakeResult {
+	if len(limit.Rules) > 0 {
+		return m.takeComposite(limit, n, now)
+	}
+
+	switch limit.Strategy {
+	case LeakyBucket:
+		return m.takeLeakyBucket(limit, n, now, wait)
+	case GCRA:
+		return m.takeGCRA(limit, n, now, wait)
+	case SlidingWindowCounter:
+		return m.takeSlidingCounter(limit, n, now)
+	case SlidingLog:
+		return m.takeSlidingLog(limit, newEntryID(), n, now, wait)
+	}
+	return m.takeFixedWindow(limit, newEntryID(), n, now, wait)
+}
+
+// Cancel gives back the room for n requests that was reserved at window
+func (s *MemoryStore) Cancel(limit *Limit, window int64, id string, n int, now int64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if now >= window {
+		return false, nil
+	}
+
+	state := s.state(limit.KeyPrefix + limit.Token)
+	switch limit.Strategy {
+	case LeakyBucket:
+		return state.cancelLeakyBucket(limit, window, n, now), nil
+	case GCRA:
+		return state.cancelGCRA(limit, n, now), nil
+	case SlidingLog:
+		return state.cancelSlidingLog(id), nil
+	}
+	return state.cancelFixedWindow(window, n), nil
+}
+
+// Refund gives back the room for n requests that was taken at the time at,
+// as long as its window hasn't rolled over
+func (s *MemoryStore) Refund(limit *Limit, at int64, id string, n int, now int64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The levels above only get the room back when the limiter itself did
+	if limit.Parent != nil {
+		if !s.refundCounters(limit, at, n, now) {
+			return false, nil
+		}
+		for _, level := range limit.levels()[1:] {
+			s.refundCounters(level, at, n, now)
+		}
+		return true, nil
+	}
+	if len(limit.Rules) > 0 {
+		return s.refundCounters(limit, at, n, now), nil
+	}
+
+	state := s.state(limit.KeyPrefix + limit.Token)
+	switch limit.Strategy {
+	case LeakyBucket:
+		return false, nil
+	case GCRA:
+		return state.refundGCRA(limit, at, n, now), nil
+	case SlidingWindowCounter:
+		return s.refundCounters(limit, at, n, now), nil
+	case SlidingLog:
+		return state.refundSlidingLog(limit, id, n, now), nil
+	}
+	return state.refundFixedWindow(id, n, now), nil
+}
+
+// Status reports how much of the limiter is used
+func (s *MemoryStore) Status(limit *Limit, now int64) (Usage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.state(limit.KeyPrefix + limit.Token)
+	if len(limit.Rules) > 0 {
+		return compositeUsage(limit.Rules, func(interval int64, window int64) int {
+			return state.ruleCounters[interval][window]
+		}, now), nil
+	}
+
+	switch limit.Strategy {
+	case LeakyBucket:
+		return leakyBucketUsage(limit, state.nextSlot, now), nil
+	case GCRA:
+		return gcraUsage(limit, state.tat, now), nil
+	case SlidingWindowCounter:
+		window := now / limit.TimeInterval
+		return slidingCounterUsage(limit.MaxRequests, limit.TimeInterval, state.counters[window], state.counters[window-1], now), nil
+	case SlidingLog:
+		count := 0
+		var oldest int64
+		for _, entry := range state.log {
+			if entry.at > now-limit.TimeInterval {
+				if count == 0 {
+					oldest = entry.at
+				}
+				count++
+			}
+		}
+		return slidingLogUsage(limit, count, oldest, now), nil
+	}
+
+	if state.windowEnd <= now {
+		return fixedWindowUsage(limit, 0, -1, now), nil
+	}
+	return fixedWindowUsage(limit, state.count, state.windowEnd-now, now), nil
+}
+
+// state returns the state for the prefixed token, creating it when there is
+// none
+func (s *MemoryStore) state(token string) *memoryState {
+	state, ok := s.states[token]
+	if !ok {
+		state = &memoryState{
+			admitted:     make(map[string]int),
+			reserved:     make(map[int64]int),
+			counters:     make(map[int64]int),
+			ruleCounters: make(map[int64]map[int64]int),
+			queue:        make(map[int64]int64),
+		}
+		s.states[token] = state
+	}
+	return state
+}
+
+// sweep drops the states that hold nothing anymore, once every sweep
+// interval, so that the states of limiters that are no longer entered, such
+// as those of the keys of a KeyedLimiter, don't pile up
+func (s *MemoryStore) sweep(now int64) {
+	if now < s.nextSweep {
+		return
+	}
+
+	for token, state := range s.states {
+		if state.expiry <= now {
+			delete(s.states, token)
+		}
+	}
+	s.nextSweep = now + memorySweepInterval
+}
+
+// heldUntil returns the time (in ms) the state holds nothing after, which is
+// when the last of its windows, entries, counters, TAT, slots and tickets
+// has expired
+func (m *memoryState) heldUntil(limit *Limit) int64 {
+	until := m.windowEnd
+	extend := func(expiry int64) {
+		if expiry > until {
+			until = expiry
+		}
+	}
+
+	for start := range m.reserved {
+		extend(start + limit.TimeInterval)
+	}
+	if len(m.log) > 0 {
+		extend(m.log[len(m.log)-1].at + limit.TimeInterval)
+	}
+
+	// A counter counts until the window after it is over
+	for _, rule := range limit.counterRules() {
+		counters := m.counters
+		if len(limit.Rules) > 0 {
+			counters = m.ruleCounters[rule.interval()]
+		}
+		for window := range counters {
+			extend((window + 2) * rule.interval())
+		}
+	}
+
+	extend(int64(math.Ceil(m.tat)))
+	extend(int64(math.Ceil(m.nextSlot)))
+	for _, expiry := range m.queue {
+		extend(expiry)
+	}
+	return until
+}
+
+/**
+ * FixedWindow
+ */
+
+// takeFixedWindow follows the fixedWindowScript
+func (m *memoryState) takeFixedWindow(limit *Limit, id string, n int, now int64, wait int64) TakeResult {
+	max, interval := limit.MaxRequests, limit.TimeInterval
+	if n > max {
+		return TakeResult{Delay: -1}
+	}
+
+	// Forget the reserved windows that have passed. What is left is a chain
+	// of windows, interval ms apart, starting w/ the earliest one
+	var chain int64
+	hasChain := false
+	for start := range m.reserved {
+		if start+interval <= now {
+			delete(m.reserved, start)
+		} else if !hasChain || start < chain {
+			chain = start
+			hasChain = true
+		}
+	}
+
+	if m.windowEnd <= now {
+		m.count = 0
+		m.admitted = make(map[string]int)
+	}
+
+	windowEnd := now + interval
+	if m.count == 0 && hasChain {
+		if chain <= now {
+			// A reserved window has begun, it becomes the current window
+			windowEnd = chain + interval
+			m.count = m.reserved[chain]
+			m.admitted = make(map[string]int)
+			m.windowEnd = windowEnd
+			delete(m.reserved, chain)
+			chain += interval
+		} else if chain < now+interval {
+			// A new window can't run into a reserved one
+			windowEnd = chain
+		}
+	}
+
+	if m.count+n <= max {
+		if m.count == 0 {
+			m.windowEnd = windowEnd
+		}
+		m.count += n
+		m.admitted[id] += n
+		return TakeResult{Admitted: true, ID: id}
+	}
+
+	// The current window is full, find the first upcoming window w/ room
+	start := chain
+	if !hasChain {
+		start = m.windowEnd
+	}
+	for m.reserved[start]+n > max {
+		start += interval
+	}
+
+	delay := start - now
+	if delay < 0 {
+		delay = 0
+	}
+	if wait >= 0 && delay > wait {
+		return TakeResult{Delay: delay}
+	}
+
+	m.reserved[start] += n
+	return TakeResult{Admitted: true, Delay: delay, Window: start}
+}
+
+// refundFixedWindow follows the refund of the RedisStore, which removes the
+// entries of the take from the list of the current window
+func (m *memoryState) refundFixedWindow(id string, n int, now int64) bool {
+	if m.windowEnd <= now || m.admitted[id] == 0 {
+		return false
+	}
+
+	if n > m.admitted[id] {
+		n = m.admitted[id]
+	}
+	m.admitted[id] -= n
+	m.count -= n
+	return true
+}
+
+// cancelFixedWindow follows the fixedWindowCancelScript
+func (m *memoryState) cancelFixedWindow(window int64, n int) bool {
+	m.reserved[window] -= n
+	if m.reserved[window] < 0 {
+		m.reserved[window] = 0
+	}
+	return true
+}
+
+/**
+ * SlidingLog
+ */
+
+// takeSlidingLog follows the slidingLogScript
+func (m *memoryState) takeSlidingLog(limit *Limit, id string, n int, now int64, wait int64) TakeResult {
+	max, interval := limit.MaxRequests, limit.TimeInterval
+	if n > max {
+		return TakeResult{Delay: -1}
+	}
+
+	// Drop the entries that left the rolling interval
+	kept := m.log[:0]
+	for _, entry := range m.log {
+		if entry.at > now-interval {
+			kept = append(kept, entry)
+		}
+	}
+	m.log = kept
+
+	// When full, room opens up once the entry that puts us over the max
+	// leaves the rolling interval
+	at := now
+	if count := len(m.log); count+n > max {
+		at = m.log[count+n-max-1].at + interval
+	}
+
+	delay := at - now
+	if wait >= 0 && delay > wait {
+		return TakeResult{Delay: delay}
+	}
+
+	for i := 1; i <= n; i++ {
+		m.log = append(m.log, memoryEntry{at: at, member: fmt.Sprintf("%s:%d", id, i)})
+	}
+	sort.SliceStable(m.log, func(i, j int) bool {
+		if m.log[i].at != m.log[j].at {
+			return m.log[i].at < m.log[j].at
+		}
+		return m.log[i].member < m.log[j].member
+	})
+
+	if delay == 0 {
+		return TakeResult{Admitted: true, ID: id}
+	}
+	return TakeResult{Admitted: true, Delay: delay, Window: at, ID: id}
+}
+
+// cancelSlidingLog follows the slidingLogCancelScript
+func (m *memoryState) cancelSlidingLog(id string) bool {
+	kept := m.log[:0]
+	for _, entry := range m.log {
+		if !strings.HasPrefix(entry.member, id+":") {
+			kept = append(kept, entry)
+		}
+	}
+	m.log = kept
+	return true
+}
+
+// refundSlidingLog follows the slidingLogRefundScript
+func (m *memoryState) refundSlidingLog(limit *Limit, id string, n int, now int64) bool {
+	members := make(map[string]bool, n)
+	for i := 1; i <= n; i++ {
+		members[fmt.Sprintf("%s:%d", id, i)] = true
+	}
+
+	refunded := false
+	kept := m.log[:0]
+	for _, entry := range m.log {
+		if members[entry.member] && entry.at > now-limit.TimeInterval {
+			refunded = true
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	m.log = kept
+	return refunded
+}
+
+/**
+ * SlidingWindowCounter
+ */
+
+// takeSlidingCounter follows the slidingCounterScript
+func (m *memoryState) takeSlidingCounter(limit *Limit, n int, now int64) TakeResult {
+	if n > limit.MaxRequests {
+		return TakeResult{Delay: -1}
+	}
+
+	if delay := slidingCounterDelay(m.counters, limit.MaxRequests, limit.TimeInterval, n, now); delay > 0 {
+		return TakeResult{Delay: delay}
+	}
+	m.counters[now/limit.TimeInterval] += n
+	return TakeResult{Admitted: true}
+}
+
+// slidingCounterDelay forgets the counters that are no longer of interest,
+// and returns the delay until there is room for n requests, or 0 when there
+// is room now
+func slidingCounterDelay(counters map[int64]int, max int, interval int64, n int, now int64) int64 {
+	current := now / interval
+	elapsed := now - current*interval
+
+	// Only the current and previous counters are of interest
+	for window := range counters {
+		if window < current-1 {
+			delete(counters, window)
+		}
+	}
+
+	count := counters[current]
+	previous := counters[current-1]
+
+	weight := float64(interval-elapsed) / float64(interval)
+	if float64(previous)*weight+float64(count+n) <= float64(max) {
+		return 0
+	}
+
+	var delay int64
+	if count+n <= max {
+		// Wait for the weight of the previous window to fall far enough
+		target := float64(max-count-n) / float64(previous)
+		delay = int64(math.Ceil(float64(interval)*(1-target) - float64(elapsed)))
+	} else {
+		// Wait for the next window, where the current one becomes the
+		// previous one, and for its weight to fall far enough
+		target := float64(max-n) / float64(count)
+		delay = interval - elapsed + int64(math.Ceil(float64(interval)*(1-target)))
+	}
+
+	if delay < 1 {
+		delay = 1
+	}
+	return delay
+}
+
+// refundCounters follows the counterRefundScript for every rule of the
+// limit
+func (s *MemoryStore) refundCounters(limit *Limit, at int64, n int, now int64) bool {
+	refunded := false
+	for _, rule := range limit.counterRules() {
+		if refundCounter(s.counters(limit, rule), rule.interval(), at, n, now) {
+			refunded = true
+		}
+	}
+	return refunded
+}
+
+// counters returns the counters of the rule of the limit, by the index of
+// the window
+func (s *MemoryStore) counters(limit *Limit, rule Rule) map[int64]int {
+	state := s.state(limit.KeyPrefix + limit.Token)
+	if len(limit.Rules) == 0 {
+		return state.counters
+	}
+
+	counters, ok := state.ruleCounters[rule.interval()]
+	if !ok {
+		counters = make(map[int64]int)
+		state.ruleCounters[rule.interval()] = counters
+	}
+	return counters
+}
+
+// refundCounter follows the counterRefundScript for the counters of a
+// single window size
+func refundCounter(counters map[int64]int, interval int64, at int64, n int, now int64) bool {
+	window := at / interval
+	if window != now/interval || counters[window] < n {
+		return false
+	}
+	counters[window] -= n
+	return true
+}
+
+/**
+ * Composite
+ */
+
+// takeComposite follows the compositeScript
+func (m *memoryState) takeComposite(limit *Limit, n int, now int64) TakeResult {
+	for _, rule := range limit.Rules {
+		if n > rule.MaxRequests {
+			return TakeResult{Delay: -1}
+		}
+	}
+
+	// Forget the counters of rules the limiter no longer has
+	for interval := range m.ruleCounters {
+		if !hasRuleInterval(limit.Rules, interval) {
+			delete(m.ruleCounters, interval)
+		}
+	}
+
+	// The request waits for the rule that has room last
+	var delay int64
+	for _, rule := range limit.Rules {
+		counters, ok := m.ruleCounters[rule.interval()]
+		if !ok {
+			counters = make(map[int64]int)
+			m.ruleCounters[rule.interval()] = counters
+		}
+
+		ruleDelay := slidingCounterDelay(counters, rule.MaxRequests, rule.interval(), n, now)
+		if ruleDelay > delay {
+			delay = ruleDelay
+		}
+	}
+	if delay > 0 {
+		return TakeResult{Delay: delay}
+	}
+
+	for _, rule := range limit.Rules {
+		m.ruleCounters[rule.interval()][now/rule.interval()] += n
+	}
+	return TakeResult{Admitted: true}
+}
+
+// hasRuleInterval reports whether one of the rules has the interval (in ms)
+func hasRuleInterval(rules []Rule, interval int64) bool {
+	for _, rule := range rules {
+		if rule.interval() == interval {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Hierarchy
+ */
+
+// takeHierarchy follows the hierarchyScript
+func (s *MemoryStore) takeHierarchy(limit *Limit, n int, now int64) TakeResult {
+	// The request waits for the level that has room last
+	var delay int64
+	denied := 0
+	for i, level := range limit.levels() {
+		for _, rule := range level.counterRules() {
+			if n > rule.MaxRequests {
+				return TakeResult{Delay: -1, Level: i}
+			}
+
+			ruleDelay := slidingCounterDelay(s.counters(level, rule), rule.MaxRequests, rule.interval(), n, now)
+			if ruleDelay > delay {
+				delay = ruleDelay
+				denied = i
+			}
+		}
+	}
+	if delay > 0 {
+		return TakeResult{Delay: delay, Level: denied}
+	}
+
+	for _, level := range limit.levels() {
+		for _, rule := range level.counterRules() {
+			s.counters(level, rule)[now/rule.interval()] += n
+		}
+		state := s.state(level.KeyPrefix + level.Token)
+		state.expiry = state.heldUntil(level)
+	}
+	return TakeResult{Admitted: true}
+}
+
+/**
+ * Fair Queue
+ */
+
+// Enqueue hands out the next ticket of the limiter
+func (s *MemoryStore) Enqueue(limit *Limit, now int64, ttl int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sweep(now)
+	state := s.state(limit.KeyPrefix + limit.Token)
+	state.tickets++
+	state.queue[state.tickets] = now + ttl
+	state.expiry = state.heldUntil(limit)
+	return state.tickets, nil
+}
+
+// Turn renews the ticket, and counts the tickets ahead of it that haven't
+// expired
+func (s *MemoryStore) Turn(limit *Limit, ticket int64, now int64, ttl int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.state(limit.KeyPrefix + limit.Token)
+	state.queue[ticket] = now + ttl
+	state.expiry = state.heldUntil(limit)
+
+	var ahead int64
+	for waiting := range state.waitingTickets(now) {
+		if waiting < ticket {
+			ahead++
+		}
+	}
+	return ahead, nil
+}
+
+// Waiting counts the tickets in the queue that haven't expired
+func (s *MemoryStore) Waiting(limit *Limit, now int64) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return int64(len(s.state(limit.KeyPrefix + limit.Token).waitingTickets(now))), nil
+}
+
+// waitingTickets drops the tickets that expired from the queue, and returns
+// the ones left
+func (m *memoryState) waitingTickets(now int64) map[int64]int64 {
+	for waiting, expiry := range m.queue {
+		if expiry <= now {
+			delete(m.queue, waiting)
+		}
+	}
+	return m.queue
+}
+
+// Leave removes the ticket from the queue
+func (s *MemoryStore) Leave(limit *Limit, ticket int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.state(limit.KeyPrefix+limit.Token).queue, ticket)
+	return nil
+}
+
+/**
+ * GCRA
+ */
+
+// takeGCRA follows the gcraScript
+func (m *memoryState) takeGCRA(limit *Limit, n int, now int64, wait int64) TakeResult {
+	emission, burst := limit.EmissionInterval, limit.Burst
+	if n > burst {
+		return TakeResult{Delay: -1}
+	}
+
+	tat := m.tat
+	if tat < float64(now) {
+		tat = float64(now)
+	}
+
+	newTat := tat + float64(n)*emission
+	allowAt := newTat - float64(burst)*emission
+	delay := int64(math.Ceil(allowAt - float64(now)))
+	if delay < 0 {
+		delay = 0
+	}
+	if wait >= 0 && delay > wait {
+		return TakeResult{Delay: delay}
+	}
+
+	m.tat = newTat
+	if delay == 0 {
+		return TakeResult{Admitted: true}
+	}
+	return TakeResult{Admitted: true, Delay: delay, Window: int64(math.Ceil(allowAt))}
+}
+
+// cancelGCRA follows the gcraCancelScript
+func (m *memoryState) cancelGCRA(limit *Limit, n int, now int64) bool {
+	if m.tat <= float64(now) {
+		return false
+	}
+
+	m.tat -= float64(n) * limit.EmissionInterval
+	return true
+}
+
+// refundGCRA follows the gcraRefundScript
+func (m *memoryState) refundGCRA(limit *Limit, at int64, n int, now int64) bool {
+	if float64(now) >= float64(at)+float64(limit.Burst)*limit.EmissionInterval {
+		return false
+	}
+	return m.cancelGCRA(limit, n, now)
+}
+
+/**
+ * LeakyBucket
+ */
+
+// takeLeakyBucket follows the leakyBucketScript
+func (m *memoryState) takeLeakyBucket(limit *Limit, n int, now int64, wait int64) TakeResult {
+	slot := m.nextSlot
+	if slot < float64(now) {
+		slot = float64(now)
+	}
+
+	delay := int64(math.Ceil(slot - float64(now)))
+	if wait >= 0 && delay > wait {
+		return TakeResult{Delay: delay}
+	}
+
+	m.nextSlot = slot + float64(n)*limit.slotSpacing()
+	if delay == 0 {
+		return TakeResult{Admitted: true}
+	}
+	return TakeResult{Admitted: true, Delay: delay, Window: int64(math.Ceil(slot))}
+}
+
+// cancelLeakyBucket follows the leakyBucketCancelScript
+func (m *memoryState) cancelLeakyBucket(limit *Limit, window int64, n int, now int64) bool {
+	if m.nextSlot <= float64(now) {
+		return false
+	}
+
+	// The slot time was rounded up to the ms
+	taken := m.nextSlot - float64(n)*limit.slotSpacing()
+	if offset := float64(window) - taken; offset < 0 || offset >= 1 {
+		return false
+	}
+
+	m.nextSlot = taken
+	return true
+}
@@ -0,0 +1,247 @@
+package funnel
+
+import (
+	"time"
+)
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+// MemoryStoreTest needs no redis, so it has no suite setup
+type MemoryStoreTest struct{}
+
+var _ = Suite(&MemoryStoreTest{})
+
+// newMemoryLimiter creates a limiter backed by the store
+func newMemoryLimiter(c *C, store Store, info *RateLimitInfo) *RateLimiter {
+	rateLimiter, err := NewLimiterWithStore(store, info)
+	c.Assert(err, IsNil)
+	return rateLimiter
+}
+
+// TestMissingStore tests that a limiter can't be created w/out a store
+func (m *MemoryStoreTest) TestMissingStore(c *C) {
+	_, err := NewLimiterWithStore(nil, &RateLimitInfo{Token: "memoryToken", MaxRequests: 1})
+	c.Assert(err, NotNil)
+}
+
+// TestNewLimiterWithStore tests that NewLimiter keeps its state in the store
+// it is given, w/out going through meshRedis
+func (m *MemoryStoreTest) TestNewLimiterWithStore(c *C) {
+	store := NewMemoryStore()
+	rateLimiter, err := NewLimiter(&RateLimitInfo{Token: "memoryNewToken", MaxRequests: 1, TimeInterval: 1000}, WithStore(store))
+	c.Assert(err, IsNil)
+	c.Assert(rateLimiter.store, Equals, store)
+
+	admitted, err := rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+	c.Assert(len(store.states), Equals, 1)
+}
+
+//---------
+// Test Strategies
+//---------
+
+// TestMemoryFixedWindow tests that the fixed window is full after the max,
+// and reports how long until it resets
+func (m *MemoryStoreTest) TestMemoryFixedWindow(c *C) {
+	rateLimiter := newMemoryLimiter(c, NewMemoryStore(), &RateLimitInfo{
+		Token:        "memoryFixedToken",
+		MaxRequests:  3,
+		TimeInterval: 200,
+	})
+
+	admitted, err := rateLimiter.TryEnterN(3)
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+
+	admitted, reset, err := rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(reset > 0, Equals, true)
+	c.Assert(reset <= 200*time.Millisecond, Equals, true)
+
+	time.Sleep(reset + 10*time.Millisecond)
+	admitted, err = rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+}
+
+// TestMemoryReservations tests that room reserved in an upcoming window is
+// honored, and given back when cancelled
+func (m *MemoryStoreTest) TestMemoryReservations(c *C) {
+	rateLimiter := newMemoryLimiter(c, NewMemoryStore(), &RateLimitInfo{
+		Token:        "memoryReserveToken",
+		MaxRequests:  1,
+		TimeInterval: 200,
+	})
+
+	first, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(first.Delay(), Equals, time.Duration(0))
+
+	second, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(second.OK(), Equals, true)
+	c.Assert(second.Delay() > 0, Equals, true)
+	c.Assert(second.Cancel(), IsNil)
+
+	replacement, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(replacement.window, Equals, second.window)
+
+	time.Sleep(replacement.Delay() + 10*time.Millisecond)
+	admitted, err := rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+}
+
+// TestMemorySlidingLog tests that the rolling interval never holds more than
+// the max
+func (m *MemoryStoreTest) TestMemorySlidingLog(c *C) {
+	rateLimiter := newMemoryLimiter(c, NewMemoryStore(), &RateLimitInfo{
+		Token:        "memorySlidingLogToken",
+		MaxRequests:  2,
+		TimeInterval: 200,
+		Strategy:     SlidingLog,
+	})
+
+	c.Assert(rateLimiter.EnterN(2), IsNil)
+	admitted, reset, err := rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(reset > 150*time.Millisecond, Equals, true)
+
+	time.Sleep(reset + 10*time.Millisecond)
+	admitted, err = rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+}
+
+// TestMemorySlidingCounter tests that the previous window counts by how much
+// of it overlaps the rolling interval
+func (m *MemoryStoreTest) TestMemorySlidingCounter(c *C) {
+	rateLimiter := newMemoryLimiter(c, NewMemoryStore(), &RateLimitInfo{
+		Token:        "memorySlidingCounterToken",
+		MaxRequests:  4,
+		TimeInterval: 200,
+		Strategy:     SlidingWindowCounter,
+	})
+
+	sleepUntilNextWindow(10, 200)
+	c.Assert(rateLimiter.EnterN(4), IsNil)
+
+	// Halfway into the next window, the previous window counts for 2
+	sleepUntilNextWindow(100, 200)
+	admitted, err := rateLimiter.TryEnterN(2)
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+
+	admitted, reset, err := rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(reset > 0, Equals, true)
+}
+
+// TestMemoryGCRA tests that a burst is admitted at once, and the rest at the
+// sustained rate
+func (m *MemoryStoreTest) TestMemoryGCRA(c *C) {
+	rateLimiter := newMemoryLimiter(c, NewMemoryStore(), &RateLimitInfo{
+		Token:    "memoryGCRAToken",
+		Rate:     10,
+		Burst:    3,
+		Strategy: GCRA,
+	})
+
+	admitted, err := rateLimiter.TryEnterN(3)
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+
+	admitted, reset, err := rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(reset > 90*time.Millisecond, Equals, true)
+	c.Assert(reset <= 100*time.Millisecond, Equals, true)
+}
+
+// TestMemoryLeakyBucket tests that requests are spaced evenly
+func (m *MemoryStoreTest) TestMemoryLeakyBucket(c *C) {
+	rateLimiter := newMemoryLimiter(c, NewMemoryStore(), &RateLimitInfo{
+		Token:        "memoryLeakyBucketToken",
+		MaxRequests:  10,
+		TimeInterval: 200,
+		Strategy:     LeakyBucket,
+	})
+
+	beginTime := unixInMilliseconds()
+	for i := 0; i < 4; i++ {
+		c.Assert(rateLimiter.Enter(), IsNil)
+	}
+	c.Assert(unixInMilliseconds()-beginTime >= 60, Equals, true)
+}
+
+//---------
+// Test Sharing
+//---------
+
+// TestMemoryStoreIsShared tests that limiters w/ the same token share their
+// state through the store, while other tokens are kept apart
+func (m *MemoryStoreTest) TestMemoryStoreIsShared(c *C) {
+	store := NewMemoryStore()
+	info := &RateLimitInfo{
+		Token:        "memorySharedToken",
+		MaxRequests:  2,
+		TimeInterval: 1000,
+	}
+	first := newMemoryLimiter(c, store, info)
+	second := newMemoryLimiter(c, store, info)
+	other := newMemoryLimiter(c, store, &RateLimitInfo{
+		Token:        "memoryOtherToken",
+		MaxRequests:  2,
+		TimeInterval: 1000,
+	})
+
+	c.Assert(first.EnterN(2), IsNil)
+	admitted, err := second.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+
+	admitted, err = other.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+}
+
+//---------
+// Test Eviction
+//---------
+
+// TestMemoryStoreDropsExpiredStates tests that the state of a limiter is
+// dropped once it holds nothing, while the state that is still in use is kept
+func (m *MemoryStoreTest) TestMemoryStoreDropsExpiredStates(c *C) {
+	store := NewMemoryStore()
+	limits := []*Limit{
+		{Token: "memoryFixedEvictToken", MaxRequests: 2, TimeInterval: 1000},
+		{Token: "memoryLogEvictToken", Strategy: SlidingLog, MaxRequests: 2, TimeInterval: 1000},
+		{Token: "memoryCounterEvictToken", Strategy: SlidingWindowCounter, MaxRequests: 2, TimeInterval: 1000},
+		{Token: "memoryGCRAEvictToken", Strategy: GCRA, EmissionInterval: 500, Burst: 2},
+	}
+	for _, limit := range limits {
+		_, err := store.Take(limit, 1, 10000, 0)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(len(store.states), Equals, 4)
+
+	// The counter of a SlidingWindowCounter still weighs in the next window
+	kept := &Limit{Token: "memoryKeptToken", MaxRequests: 2, TimeInterval: 1000}
+	_, err := store.Take(kept, 1, 11500, 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(store.states), Equals, 2)
+	c.Assert(store.states["memoryCounterEvictToken"], NotNil)
+
+	_, err = store.Take(kept, 1, 12500, 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(store.states), Equals, 1)
+	c.Assert(store.states["memoryKeptToken"], NotNil)
+}
@@ -0,0 +1,160 @@
+package funnel
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Option configures a RateLimiter when it is created
+type Option func(*RateLimiter) error
+
+// WithRetries sets the max amount of attempts Enter makes before giving up.
+// Defaults to 1000
+func WithRetries(retries int) Option {
+	return func(r *RateLimiter) error {
+		if retries <= 0 {
+			return errors.New("Unable to create the rate limiter. Retries must be positive")
+		}
+		r.retries = retries
+		return nil
+	}
+}
+
+// WithRetryDelay sets the time Enter waits between attempts, before the
+// backoff and randomness factor are applied. Defaults to a quarter of the
+// TimeInterval
+func WithRetryDelay(delay time.Duration) Option {
+	return func(r *RateLimiter) error {
+		if delay < time.Millisecond {
+			return errors.New("Unable to create the rate limiter. The retry delay must be at least 1ms")
+		}
+		r.delay = int64(delay / time.Millisecond)
+		return nil
+	}
+}
+
+// WithBackoff makes the time Enter waits between attempts grow by the
+// multiplier after each attempt, up to max. A max of 0 lets it grow w/out a
+// cap. Defaults to a multiplier of 1, which keeps the wait constant
+func WithBackoff(multiplier float64, max time.Duration) Option {
+	return func(r *RateLimiter) error {
+		if multiplier < 1 {
+			return errors.New("Unable to create the rate limiter. The backoff multiplier must be at least 1")
+		}
+		if max < 0 {
+			return errors.New("Unable to create the rate limiter. The max backoff can't be negative")
+		}
+		r.backoff = multiplier
+		r.maxDelay = int64(max / time.Millisecond)
+		return nil
+	}
+}
+
+// WithMaxWait sets the most time Enter waits for its slot under the
+// LeakyBucket strategy, which hands out slots however far ahead they are. A
+// request whose slot is further ahead is turned down w/ a LimitError, and
+// takes no slot. Defaults to the retries times the retry delay
+func WithMaxWait(max time.Duration) Option {
+	return func(r *RateLimiter) error {
+		if max < time.Millisecond {
+			return errors.New("Unable to create the rate limiter. The max wait must be at least 1ms")
+		}
+		r.maxWait = int64(max / time.Millisecond)
+		return nil
+	}
+}
+
+// WithJitter sets the randomness factor applied to the time Enter waits
+// between attempts. Each wait is lengthened by up to factor times itself, so
+// that contending processes don't retry in step. A factor of 0 turns the
+// randomness off. Defaults to 0.5
+func WithJitter(factor float64) Option {
+	return func(r *RateLimiter) error {
+		if factor < 0 {
+			return errors.New("Unable to create the rate limiter. The jitter factor can't be negative")
+		}
+		r.factor = factor
+		return nil
+	}
+}
+
+// WithLockExpiry sets the time a lock on the limiter is held for at most.
+// Only a QuorumStore takes a lock. Defaults to 1 second
+func WithLockExpiry(expiry time.Duration) Option {
+	return func(r *RateLimiter) error {
+		if expiry < time.Millisecond {
+			return errors.New("Unable to create the rate limiter. The lock expiry must be at least 1ms")
+		}
+		r.lockExpiry = int64(expiry / time.Millisecond)
+		return nil
+	}
+}
+
+// WithKeyPrefix sets a prefix for every key the limiter keeps its state
+// under, such as to share a redis w/ other applications
+func WithKeyPrefix(prefix string) Option {
+	return func(r *RateLimiter) error {
+		if strings.ContainsAny(prefix, "{}") {
+			return errors.New("Unable to create the rate limiter. The key prefix can't contain braces, they would break the hash tag of the keys")
+		}
+		r.keyPrefix = prefix
+		return nil
+	}
+}
+
+// WithStrategy sets the algorithm used to count the requests. Defaults to
+// FixedWindow
+func WithStrategy(strategy Strategy) Option {
+	return func(r *RateLimiter) error {
+		if !strategy.valid() {
+			return fmt.Errorf("Unable to create the rate limiter. Unknown rate limiting strategy: %d", strategy)
+		}
+		r.strategy = strategy
+		return nil
+	}
+}
+
+// WithStore sets the store the limiter keeps its state in. Defaults to
+// redis, through the meshRedis pool
+func WithStore(store Store) Option {
+	return func(r *RateLimiter) error {
+		if store == nil {
+			return errors.New("Unable to create the rate limiter. The store can't be nil")
+		}
+		r.store = store
+		return nil
+	}
+}
+
+// WithClock sets the clock the limiter reads the time from. The store
+// measures its windows w/ it, while waits between attempts are still slept
+// in real time. Defaults to the system clock
+func WithClock(clock Clock) Option {
+	return func(r *RateLimiter) error {
+		if clock == nil {
+			return errors.New("Unable to create the rate limiter. The clock can't be nil")
+		}
+		r.clock = clock
+		return nil
+	}
+}
+
+/**
+ * Clock
+ */
+
+// Clock tells the time to a limiter
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+}
+
+// systemClock tells the time of the system
+type systemClock struct{}
+
+// Now returns the current time of the system
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,250 @@
+package funnel
+
+import (
+	"time"
+)
+
+import (
+	"github.com/garyburd/redigo/redis"
+	. "gopkg.in/check.v1"
+)
+
+// OptionTest uses its own pools rather than the meshRedis one
+type OptionTest struct{}
+
+var _ = Suite(&OptionTest{})
+
+// newTestPool creates a pool for the local redis database
+func newTestPool(db int) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle: 3,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", "127.0.0.1:6379", redis.DialDatabase(db))
+		},
+	}
+}
+
+// newPoolLimiter creates a cleared limiter on the pool
+func newPoolLimiter(c *C, pool *redis.Pool, token string, max int, opts ...Option) *RateLimiter {
+	limiterInfo := &RateLimitInfo{
+		Token:        token,
+		MaxRequests:  max,
+		TimeInterval: 1000,
+	}
+
+	rateLimiter, err := NewLimiterWithPool(pool, limiterInfo, opts...)
+	c.Assert(err, IsNil)
+
+	conn := pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("DEL", rateLimiter.limit().rateLimiterToken())
+	c.Assert(err, IsNil)
+	return rateLimiter
+}
+
+//---------
+// Test Pools
+//---------
+
+// TestLimitersOnDifferentPools tests that limiters w/ the same token keep
+// their state apart when their pools target different databases
+func (o *OptionTest) TestLimitersOnDifferentPools(c *C) {
+	first := newTestPool(0)
+	defer first.Close()
+	second := newTestPool(1)
+	defer second.Close()
+
+	firstLimiter := newPoolLimiter(c, first, "poolToken", 1)
+	secondLimiter := newPoolLimiter(c, second, "poolToken", 1)
+
+	admitted, err := firstLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+	admitted, err = firstLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+
+	admitted, err = secondLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+}
+
+// TestMissingPool tests that limiters can't be created w/out a pool
+func (o *OptionTest) TestMissingPool(c *C) {
+	_, err := NewLimiterWithPool(nil, &RateLimitInfo{Token: "poolToken", MaxRequests: 1})
+	c.Assert(err, NotNil)
+
+	_, err = NewConcurrencyLimiterWithPool(nil, &ConcurrencyInfo{Token: "poolToken", MaxConcurrent: 1})
+	c.Assert(err, NotNil)
+}
+
+// TestConcurrencyLimiterWithPool tests that a concurrency limiter works on
+// its own pool
+func (o *OptionTest) TestConcurrencyLimiterWithPool(c *C) {
+	pool := newTestPool(1)
+	defer pool.Close()
+
+	limiter, err := NewConcurrencyLimiterWithPool(pool, &ConcurrencyInfo{Token: "poolToken", MaxConcurrent: 1})
+	c.Assert(err, IsNil)
+
+	conn := pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("DEL", limiter.leasesToken())
+	c.Assert(err, IsNil)
+
+	lease, err := limiter.TryAcquire()
+	c.Assert(err, IsNil)
+	c.Assert(lease, NotNil)
+	c.Assert(lease.Release(), IsNil)
+}
+
+//---------
+// Test Options
+//---------
+
+// TestWithRetries tests that Enter gives up after the given attempts
+func (o *OptionTest) TestWithRetries(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	rateLimiter := newPoolLimiter(c, pool, "retriesToken", 1, WithRetries(2), WithRetryDelay(10*time.Millisecond))
+	c.Assert(rateLimiter.Enter(), IsNil)
+
+	beginTime := unixInMilliseconds()
+	err := rateLimiter.Enter()
+	c.Assert(err, ErrorMatches, ".*Max attempts hit.*")
+	c.Assert(unixInMilliseconds()-beginTime < 100, Equals, true)
+}
+
+// TestInvalidOptions tests that limiters can't be created w/ invalid options
+func (o *OptionTest) TestInvalidOptions(c *C) {
+	limiterInfo := &RateLimitInfo{Token: "optionsToken", MaxRequests: 1}
+
+	_, err := NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithRetries(0))
+	c.Assert(err, NotNil)
+
+	_, err = NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithRetryDelay(0))
+	c.Assert(err, NotNil)
+
+	_, err = NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithBackoff(0.5, 0))
+	c.Assert(err, NotNil)
+
+	_, err = NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithJitter(-1))
+	c.Assert(err, NotNil)
+
+	_, err = NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithKeyPrefix("{app}"))
+	c.Assert(err, NotNil)
+
+	_, err = NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithStrategy(Strategy(42)))
+	c.Assert(err, NotNil)
+
+	_, err = NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithClock(nil))
+	c.Assert(err, NotNil)
+}
+
+// TestInvalidCombinations tests that options that don't go together are
+// turned down
+func (o *OptionTest) TestInvalidCombinations(c *C) {
+	limiterInfo := &RateLimitInfo{Token: "optionsToken", MaxRequests: 1, TimeInterval: 1000}
+
+	_, err := NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithRetryDelay(100*time.Millisecond), WithBackoff(2, 50*time.Millisecond))
+	c.Assert(err, ErrorMatches, ".*max backoff of 50ms is less than the retry delay of 100ms.*")
+
+	_, err = NewLimiterWithStore(NewMemoryStore(), limiterInfo, WithLockExpiry(time.Second))
+	c.Assert(err, ErrorMatches, ".*only applies to a QuorumStore.*")
+}
+
+//---------
+// Test New
+//---------
+
+// fakeClock is a clock that only moves when told to
+type fakeClock struct {
+	// now is the time the clock tells
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+// TestNew tests a limiter created from a limit per interval and options
+func (o *OptionTest) TestNew(c *C) {
+	rateLimiter, err := New("newToken", 2, time.Second, WithStore(NewMemoryStore()), WithRetries(1))
+	c.Assert(err, IsNil)
+	c.Assert(rateLimiter.limit().TimeInterval, Equals, int64(1000))
+
+	c.Assert(rateLimiter.Enter(), IsNil)
+	c.Assert(rateLimiter.Enter(), IsNil)
+	c.Assert(rateLimiter.Enter(), NotNil)
+}
+
+// TestNewValidation tests that New turns down invalid limits
+func (o *OptionTest) TestNewValidation(c *C) {
+	_, err := New("", 1, time.Second)
+	c.Assert(err, ErrorMatches, ".*token is required.*")
+
+	_, err = New("newToken", 0, time.Second)
+	c.Assert(err, ErrorMatches, ".*limit must be positive.*")
+
+	_, err = New("newToken", 1, time.Microsecond)
+	c.Assert(err, ErrorMatches, ".*at least 1ms.*")
+}
+
+// TestNewWithStrategy tests that the strategy given as an option is setup
+func (o *OptionTest) TestNewWithStrategy(c *C) {
+	rateLimiter, err := New("newGCRAToken", 10, time.Second, WithStore(NewMemoryStore()), WithStrategy(GCRA))
+	c.Assert(err, IsNil)
+	c.Assert(rateLimiter.burst, Equals, 10)
+	c.Assert(rateLimiter.emissionInterval, Equals, float64(100))
+}
+
+// TestWithClock tests that the windows are measured on the given clock
+func (o *OptionTest) TestWithClock(c *C) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	rateLimiter, err := New("clockToken", 1, time.Minute, WithStore(NewMemoryStore()), WithClock(clock))
+	c.Assert(err, IsNil)
+
+	assertAdmits(c, rateLimiter, true)
+	assertAdmits(c, rateLimiter, false)
+
+	clock.now = clock.now.Add(time.Minute)
+	assertAdmits(c, rateLimiter, true)
+}
+
+// TestWithKeyPrefix tests that the keys of the limiter go under the prefix
+func (o *OptionTest) TestWithKeyPrefix(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	rateLimiter := newPoolLimiter(c, pool, "prefixToken", 5, WithKeyPrefix("app:"))
+	c.Assert(rateLimiter.Enter(), IsNil)
+
+	conn := pool.Get()
+	defer conn.Close()
+	count, err := redis.Int(conn.Do("LLEN", "app:{prefixToken_rateLimiterToken}_rateLimiterToken"))
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 1)
+}
+
+// TestWithBackoff tests that the delay grows by the multiplier up to the max
+func (o *OptionTest) TestWithBackoff(c *C) {
+	rateLimiter, err := New("backoffToken", 1, time.Second, WithStore(NewMemoryStore()), WithRetryDelay(10*time.Millisecond), WithBackoff(2, 50*time.Millisecond))
+	c.Assert(err, IsNil)
+
+	var delays []int64
+	delay := rateLimiter.delay
+	for i := 0; i < 4; i++ {
+		delay = rateLimiter.nextDelay(delay)
+		delays = append(delays, delay)
+	}
+	c.Assert(delays, DeepEquals, []int64{20, 40, 50, 50})
+}
+
+// TestDefaultRetryDelay tests that a limiter w/out an interval still waits
+// between attempts
+func (o *OptionTest) TestDefaultRetryDelay(c *C) {
+	rateLimiter, err := NewLimiterWithStore(NewMemoryStore(), &RateLimitInfo{Token: "delayToken", MaxRequests: 1})
+	c.Assert(err, IsNil)
+	c.Assert(rateLimiter.delay, Equals, int64(100))
+}
@@ -0,0 +1,288 @@
+package funnel
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hjr265/redsync.go/redsync"
+	"github.com/meshhq/meshRedis"
+)
+
+const (
+	// quorumLockExpiry is the time the lock on the nodes is held for at most.
+	// It only has to outlast a single round of scripts
+	quorumLockExpiry = time.Second
+
+	// quorumLockTries is the max amount of attempts to take the lock
+	quorumLockTries = 64
+
+	// quorumLockDelay is the time (in ms) to wait between attempts to take
+	// the lock, before the randomness factor is applied
+	quorumLockDelay = 5
+)
+
+// QuorumStore keeps the state of rate limiters on several independent redis
+// nodes. Each take holds a Redlock lock on a quorum of the nodes, so the
+// nodes see the same sequence of takes, and is only admitted when a quorum of
+// the nodes admit it. A minority of the nodes going down neither stops nor
+// double admits requests.
+//
+// A node that admitted a request the quorum turned down keeps counting it
+// until its window passes, which only ever errs on the side of fewer requests
+type QuorumStore struct {
+	// nodes are the stores of each node
+	nodes []*RedisStore
+
+	// pools are the pools of each node, for the lock
+	pools []redsync.Pool
+
+	// quorum is the amount of nodes that must agree
+	quorum int
+}
+
+// NewQuorumStore is a factory method for creating a store on the nodes of
+// the pools. The quorum is a majority of the nodes
+func NewQuorumStore(pools ...meshRedis.RedPool) (*QuorumStore, error) {
+	if len(pools) == 0 {
+		return nil, errors.New("Unable to create the quorum store. At least one Redis pool is required")
+	}
+
+	store := &QuorumStore{quorum: len(pools)/2 + 1}
+	for _, pool := range pools {
+		if pool == nil {
+			return nil, errors.New("Unable to create the quorum store. A Redis pool is missing")
+		}
+		store.nodes = append(store.nodes, NewRedisStore(pool))
+		store.pools = append(store.pools, pool)
+	}
+	return store, nil
+}
+
+// Take takes room for n requests on every node while holding the lock, and
+// admits the requests when a quorum of the nodes did
+func (s *QuorumStore) Take(limit *Limit, n int, now int64, wait int64) (TakeResult, error) {
+	mutex := s.mutex(limit)
+	if err := lockError(mutex.Lock()); err != nil {
+		return TakeResult{}, err
+	}
+	defer mutex.Unlock()
+
+	var id string
+	if len(limit.Rules) == 0 && limit.Strategy.tracksEntries() {
+		id = newEntryID()
+	}
+
+	results := make([]TakeResult, len(s.nodes))
+	errs := make([]error, len(s.nodes))
+	s.onEachNode(func(i int, node *RedisStore) {
+		results[i], errs[i] = node.takeWithID(limit, id, n, now, wait)
+	})
+
+	// Admitted w/ the latest delay among the nodes that admitted, or turned
+	// down until enough nodes have room to make a quorum. Each node that
+	// turned the request down keeps its own level
+	var admitted TakeResult
+	var denied []TakeResult
+	answered := 0
+	for i, result := range results {
+		if errs[i] != nil {
+			continue
+		}
+		answered++
+		if !result.Admitted {
+			denied = append(denied, result)
+		} else if !admitted.Admitted || result.Delay > admitted.Delay {
+			admitted = result
+		}
+	}
+
+	if answered < s.quorum {
+		return TakeResult{}, firstError(errs)
+	}
+	if answered-len(denied) >= s.quorum {
+		admitted.ID = quorumID(id, results, errs)
+		return admitted, nil
+	}
+
+	sort.SliceStable(denied, func(i, j int) bool { return denied[i].Delay < denied[j].Delay })
+	if denied[0].Delay < 0 {
+		return TakeResult{Delay: -1, Level: denied[0].Level}, nil
+	}
+	result := denied[s.quorum-(answered-len(denied))-1]
+	return TakeResult{Delay: result.Delay, ID: id, Level: result.Level}, nil
+}
+
+// Cancel gives back the room on every node while holding the lock, and
+// reports whether a quorum of the nodes gave it back
+func (s *QuorumStore) Cancel(limit *Limit, window int64, id string, n int, now int64) (bool, error) {
+	mutex := s.mutex(limit)
+	if err := lockError(mutex.Lock()); err != nil {
+		return false, err
+	}
+	defer mutex.Unlock()
+
+	// Each node gives back the room it took itself, at its own window
+	id, windows := parseQuorumID(id, window, len(s.nodes))
+	cancelled := make([]bool, len(s.nodes))
+	errs := make([]error, len(s.nodes))
+	s.onEachNode(func(i int, node *RedisStore) {
+		if windows[i] != nil {
+			cancelled[i], errs[i] = node.Cancel(limit, *windows[i], id, n, now)
+		}
+	})
+
+	answered, given := 0, 0
+	for i := range cancelled {
+		if errs[i] == nil {
+			answered++
+		}
+		if cancelled[i] {
+			given++
+		}
+	}
+	if answered < s.quorum {
+		return false, firstError(errs)
+	}
+	return given >= s.quorum, nil
+}
+
+// Refund gives back the room on every node while holding the lock, and
+// reports whether a quorum of the nodes gave it back
+func (s *QuorumStore) Refund(limit *Limit, at int64, id string, n int, now int64) (bool, error) {
+	mutex := s.mutex(limit)
+	if err := lockError(mutex.Lock()); err != nil {
+		return false, err
+	}
+	defer mutex.Unlock()
+
+	// Only the nodes that took the room give it back
+	id, windows := parseQuorumID(id, 0, len(s.nodes))
+	refunded := make([]bool, len(s.nodes))
+	errs := make([]error, len(s.nodes))
+	s.onEachNode(func(i int, node *RedisStore) {
+		if windows[i] != nil {
+			refunded[i], errs[i] = node.Refund(limit, at, id, n, now)
+		}
+	})
+
+	answered, given := 0, 0
+	for i := range refunded {
+		if errs[i] == nil {
+			answered++
+		}
+		if refunded[i] {
+			given++
+		}
+	}
+	if answered < s.quorum {
+		return false, firstError(errs)
+	}
+	return given >= s.quorum, nil
+}
+
+// Status reads the usage on every node, and reports the usage a quorum of
+// the nodes have reached. No lock is needed, since nothing is written
+func (s *QuorumStore) Status(limit *Limit, now int64) (Usage, error) {
+	usages := make([]Usage, len(s.nodes))
+	errs := make([]error, len(s.nodes))
+	s.onEachNode(func(i int, node *RedisStore) {
+		usages[i], errs[i] = node.Status(limit, now)
+	})
+
+	var answered []Usage
+	for i, usage := range usages {
+		if errs[i] == nil {
+			answered = append(answered, usage)
+		}
+	}
+	if len(answered) < s.quorum {
+		return Usage{}, firstError(errs)
+	}
+	return quorumUsage(answered, s.quorum), nil
+}
+
+// quorumID joins the id of the take w/ the window each node took room at, so
+// that the room is only given back on the nodes that took it, each at its
+// own window. A node that didn't take room is marked w/ a "-"
+func quorumID(id string, results []TakeResult, errs []error) string {
+	windows := make([]string, len(results))
+	for i, result := range results {
+		windows[i] = "-"
+		if errs[i] == nil && result.Admitted {
+			windows[i] = strconv.FormatInt(result.Window, 10)
+		}
+	}
+	return id + "|" + strings.Join(windows, ",")
+}
+
+// parseQuorumID splits the id of a take made by quorumID into the id of its
+// entries and the window of each node, which is nil for a node that didn't
+// take room. An id of another store is taken by every node at the window
+func parseQuorumID(id string, window int64, nodes int) (string, []*int64) {
+	windows := make([]*int64, nodes)
+	sep := strings.LastIndex(id, "|")
+	fields := strings.Split(id[sep+1:], ",")
+	if sep < 0 || len(fields) != nodes {
+		for i := range windows {
+			windows[i] = &window
+		}
+		return id, windows
+	}
+
+	for i, field := range fields {
+		if start, err := strconv.ParseInt(field, 10, 64); err == nil {
+			windows[i] = &start
+		}
+	}
+	return id[:sep], windows
+}
+
+// mutex returns the Redlock lock for the limiter on the nodes
+func (s *QuorumStore) mutex(limit *Limit) *redsync.Mutex {
+	mutex, _ := redsync.NewMutexWithGenericPool(limit.lockToken(), s.pools)
+
+	// Add randomness to the waiting so contending processes don't lock in
+	// step w/ each other
+	mutex.Expiry = quorumLockExpiry
+	if limit.LockExpiry > 0 {
+		mutex.Expiry = time.Duration(limit.LockExpiry) * time.Millisecond
+	}
+	mutex.Tries = quorumLockTries
+	mutex.Delay = jitter(defaultFactor, quorumLockDelay)
+	return mutex
+}
+
+// onEachNode runs f on every node at once, and waits for all of them
+func (s *QuorumStore) onEachNode(f func(i int, node *RedisStore)) {
+	var wg sync.WaitGroup
+	for i, node := range s.nodes {
+		wg.Add(1)
+		go func(i int, node *RedisStore) {
+			defer wg.Done()
+			f(i, node)
+		}(i, node)
+	}
+	wg.Wait()
+}
+
+// lockError turns the lock not being taken in time into ErrLockTimeout
+func lockError(err error) error {
+	if err == redsync.ErrFailed {
+		return ErrLockTimeout
+	}
+	return err
+}
+
+// firstError returns the first error that isn't nil
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return errors.New("Unable to reach a quorum of the Redis nodes")
+}
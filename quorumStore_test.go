@@ -0,0 +1,186 @@
+package funnel
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/meshhq/meshRedis"
+	. "gopkg.in/check.v1"
+)
+
+// QuorumStoreTest treats databases of the local redis as independent nodes
+type QuorumStoreTest struct{}
+
+var _ = Suite(&QuorumStoreTest{})
+
+// newDownPool creates a pool for a node that is down
+func newDownPool() *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", "127.0.0.1:1")
+		},
+	}
+}
+
+// newQuorumLimiter creates a limiter on the pools, clearing its window on
+// every node that is up
+func newQuorumLimiter(c *C, token string, max int, pools ...*redis.Pool) *RateLimiter {
+	var nodes []meshRedis.RedPool
+	for _, pool := range pools {
+		nodes = append(nodes, pool)
+	}
+
+	rateLimiter, err := NewLimiterWithPools(nodes, &RateLimitInfo{
+		Token:        token,
+		MaxRequests:  max,
+		TimeInterval: 1000,
+	})
+	c.Assert(err, IsNil)
+
+	for _, pool := range pools {
+		conn := pool.Get()
+		conn.Do("DEL", rateLimiter.limit().rateLimiterToken())
+		conn.Close()
+	}
+	return rateLimiter
+}
+
+// assertAdmits tries to enter the limiter, and checks whether it was admitted
+func assertAdmits(c *C, rateLimiter *RateLimiter, expected bool) {
+	admitted, err := rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, expected)
+}
+
+//---------
+// Test Quorum
+//---------
+
+// TestQuorumStoreValidation tests that a quorum store needs pools
+func (q *QuorumStoreTest) TestQuorumStoreValidation(c *C) {
+	_, err := NewQuorumStore()
+	c.Assert(err, NotNil)
+
+	_, err = NewQuorumStore(newTestPool(2), nil)
+	c.Assert(err, NotNil)
+}
+
+// TestQuorumAdmitsUpToMax tests that the nodes agree on the max
+func (q *QuorumStoreTest) TestQuorumAdmitsUpToMax(c *C) {
+	rateLimiter := newQuorumLimiter(c, "quorumMaxToken", 2, newTestPool(2), newTestPool(3), newTestPool(4))
+
+	assertAdmits(c, rateLimiter, true)
+	assertAdmits(c, rateLimiter, true)
+	assertAdmits(c, rateLimiter, false)
+}
+
+// TestQuorumWithNodeDown tests that the limiter keeps working w/ a minority
+// of the nodes down
+func (q *QuorumStoreTest) TestQuorumWithNodeDown(c *C) {
+	rateLimiter := newQuorumLimiter(c, "quorumDownToken", 2, newTestPool(2), newTestPool(3), newDownPool())
+
+	assertAdmits(c, rateLimiter, true)
+	assertAdmits(c, rateLimiter, true)
+	assertAdmits(c, rateLimiter, false)
+}
+
+// TestQuorumWithoutQuorum tests that the limiter fails w/ a majority of the
+// nodes down
+func (q *QuorumStoreTest) TestQuorumWithoutQuorum(c *C) {
+	rateLimiter := newQuorumLimiter(c, "quorumLostToken", 2, newTestPool(2), newDownPool(), newDownPool())
+
+	_, err := rateLimiter.TryEnter()
+	c.Assert(err, NotNil)
+}
+
+// TestQuorumWithNodeLosingState tests that a node that lost its state, such
+// as after a restart, doesn't let more requests through
+func (q *QuorumStoreTest) TestQuorumWithNodeLosingState(c *C) {
+	restarted := newTestPool(4)
+	rateLimiter := newQuorumLimiter(c, "quorumRestartToken", 2, newTestPool(2), newTestPool(3), restarted)
+
+	assertAdmits(c, rateLimiter, true)
+	assertAdmits(c, rateLimiter, true)
+
+	conn := restarted.Get()
+	_, err := conn.Do("DEL", rateLimiter.limit().rateLimiterToken())
+	conn.Close()
+	c.Assert(err, IsNil)
+
+	assertAdmits(c, rateLimiter, false)
+}
+
+// TestQuorumUnderContention tests that concurrent takes never admit more
+// than the max
+func (q *QuorumStoreTest) TestQuorumUnderContention(c *C) {
+	rateLimiter := newQuorumLimiter(c, "quorumContentionToken", 5, newTestPool(2), newTestPool(3), newTestPool(4))
+
+	var wg sync.WaitGroup
+	var admittedCount uint64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			admitted, err := rateLimiter.TryEnter()
+			c.Assert(err, IsNil)
+			if admitted {
+				atomic.AddUint64(&admittedCount, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(admittedCount, Equals, uint64(5))
+}
+
+// TestQuorumCancelsEachNodeAtItsWindow tests that a reservation is given
+// back on each node at the window that node reserved, which differs when the
+// windows of the nodes began at different times
+func (q *QuorumStoreTest) TestQuorumCancelsEachNodeAtItsWindow(c *C) {
+	pools := []*redis.Pool{newTestPool(2), newTestPool(3), newTestPool(4)}
+	var nodes []meshRedis.RedPool
+	for _, pool := range pools {
+		nodes = append(nodes, pool)
+	}
+	store, err := NewQuorumStore(nodes...)
+	c.Assert(err, IsNil)
+
+	limit := &Limit{Token: "quorumCancelToken_rateLimiterToken", MaxRequests: 1, TimeInterval: 1000}
+	for _, pool := range pools {
+		conn := pool.Get()
+		_, err := conn.Do("DEL", limit.rateLimiterToken(), limit.reservationsToken())
+		conn.Close()
+		c.Assert(err, IsNil)
+	}
+
+	// The window of the first node begins 100ms before those of the others
+	for i, node := range store.nodes {
+		if i == 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		result, err := node.Take(limit, 1, nowInMilliseconds(), 0)
+		c.Assert(err, IsNil)
+		c.Assert(result.Admitted, Equals, true)
+	}
+
+	now := nowInMilliseconds()
+	result, err := store.Take(limit, 1, now, -1)
+	c.Assert(err, IsNil)
+	c.Assert(result.Admitted, Equals, true)
+	cancelled, err := store.Cancel(limit, result.Window, result.ID, 1, now)
+	c.Assert(err, IsNil)
+	c.Assert(cancelled, Equals, true)
+
+	for _, pool := range pools {
+		conn := pool.Get()
+		reserved, err := redis.IntMap(conn.Do("HGETALL", limit.reservationsToken()))
+		conn.Close()
+		c.Assert(err, IsNil)
+		for window, count := range reserved {
+			c.Assert(count, Equals, 0, Commentf("%s", window))
+		}
+	}
+}
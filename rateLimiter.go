@@ -1,14 +1,14 @@
 package funnel
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
-	"sync"
+	"strings"
 	"time"
 
-	"github.com/hjr265/redsync.go/redsync"
-	"github.com/meshhq/meshLog"
 	"github.com/meshhq/meshRedis"
 )
 
@@ -24,6 +24,9 @@ const (
 
 	// defaultFactor is used to add randomness to the retry logic
 	defaultFactor = 0.5
+
+	// limiterTokenSuffix is appended to the token of every rate limiter
+	limiterTokenSuffix = "_rateLimiterToken"
 )
 
 // RateLimitInfo is an inteface that provides the sufficient information to
@@ -37,17 +40,29 @@ type RateLimitInfo struct {
 
 	// TimeInterval represents the time duration that the max requests can take place inside of
 	TimeInterval int64
+
+	// Strategy is the algorithm used to count the requests. Defaults to FixedWindow
+	Strategy Strategy
+
+	// Rate is the sustained requests per second allowed by the GCRA strategy. When zero,
+	// it is MaxRequests per TimeInterval
+	Rate float64
+
+	// Burst is the max amount of requests the GCRA strategy admits at once. When zero,
+	// it is MaxRequests
+	Burst int
 }
 
 // RateLimiter controls the amount of concurrent requests from GoHttp. All time is in milliseconds
 type RateLimiter struct {
 
 	/**
-	 * REDPOOL
+	 * STORE
 	 */
 
-	// Redpool is a a reference to a struct that vendors a redigo connection
-	pool meshRedis.RedPool
+	// store keeps the state of the limiter, in redis unless another store
+	// is given
+	store Store
 
 	/**
 	 * LOCK INFO
@@ -57,6 +72,13 @@ type RateLimiter struct {
 	// limited request
 	token string
 
+	// keyPrefix goes ahead of every key the state is kept under
+	keyPrefix string
+
+	// lockExpiry is the time a lock on the limiter is held for at most, for
+	// stores that take one
+	lockExpiry int64
+
 	/**
 	 * REQUEST INFO
 	 */
@@ -69,15 +91,28 @@ type RateLimiter struct {
 	// can take place inside of
 	timeInterval int64
 
-	/**
-	 * RETRY / LOCK LOGIC
-	 */
+	// strategy is the algorithm used to count the requests
+	strategy Strategy
+
+	// emissionInterval is the time (in ms) between requests at the
+	// sustained rate of the GCRA strategy
+	emissionInterval float64
 
-	// currentCount represents the amount of attempts to acquire a lock
-	currentCount int16
+	// burst is the max amount of requests admitted at once by the GCRA
+	// strategy
+	burst int
 
-	// redMutex is a ref a dist lock
-	nodeLock *redsync.Mutex
+	// rules are the limits of a composite limiter, which all must have room
+	// for a request
+	rules []Rule
+
+	// parent is the limiter this one is nested within, which must have room
+	// for a request as well
+	parent *RateLimiter
+
+	/**
+	 * RETRY LOGIC
+	 */
 
 	// retries represents the max amount of retires to begin
 	// the window
@@ -90,165 +125,637 @@ type RateLimiter struct {
 	// factor is the factor used to change the retry attempt
 	factor float64
 
-	// mutex is the local used to avoid crowding redlock
-	mutex *sync.Mutex
+	// backoff is what the delay is multiplied by after each retry
+	backoff float64
+
+	// maxDelay is the most the delay grows to w/ the backoff, or 0 for no
+	// cap
+	maxDelay int64
+
+	// maxWait is the most time (in ms) Enter waits for a paced slot, or 0
+	// for as long as the retries would have waited
+	maxWait int64
+
+	// ticketTTL is the time a ticket in the fair queue is held for w/out
+	// being renewed, or 0 when the waiters aren't queued
+	ticketTTL int64
+
+	// queuePoll is the time a waiter of the fair queue waits per ticket ahead
+	// of it, before it checks whether it is its turn again
+	queuePoll time.Duration
+
+	// turns wakes the waiters of the fair queue in the process when a
+	// ticket leaves the queue
+	turns *queueSignal
+
+	/**
+	 * LOGGING
+	 */
+
+	// logger receives the events of the limiter
+	logger Logger
+
+	// clock tells the time to the limiter
+	clock Clock
+
+	/**
+	 * FAILURE POLICY
+	 */
+
+	// failurePolicy is what the limiter does when its store is unavailable
+	failurePolicy FailurePolicy
+
+	// expectedReplicas is the amount of processes expected to share the
+	// limiter, for the FailLocal policy
+	expectedReplicas int
+
+	// recoveryInterval is the time to wait before trying the store again
+	// once it failed, while degraded
+	recoveryInterval int64
+
+	// onModeChange is called back when the mode of the limiter changes
+	onModeChange func(Mode)
+
+	// degradation tracks whether the limiter is degraded. The limiters of a
+	// KeyedLimiter share it, since they share the store
+	degradation *degradation
 }
 
-// NewLimiter is a factory method for creating a rate limiter
-func NewLimiter(limitInfo *RateLimitInfo) (*RateLimiter, error) {
-	pool := meshRedis.UnderlyingPool()
+// New is a factory method for creating a rate limiter that admits limit
+// requests per interval. Its state is kept in redis, through the meshRedis
+// pool, unless a store is given w/ WithStore
+func New(token string, limit int, per time.Duration, opts ...Option) (*RateLimiter, error) {
+	if token == "" {
+		return nil, errors.New("Unable to create the rate limiter. A token is required")
+	}
+	if limit <= 0 {
+		return nil, errors.New("Unable to create the rate limiter. The limit must be positive")
+	}
+	if per < time.Millisecond {
+		return nil, errors.New("Unable to create the rate limiter. The interval must be at least 1ms")
+	}
+
+	limitInfo := &RateLimitInfo{
+		Token:        token,
+		MaxRequests:  limit,
+		TimeInterval: int64(per / time.Millisecond),
+	}
+	limiter, err := newLimiter(nil, limitInfo, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := limiter.setDefaultStore(); err != nil {
+		return nil, err
+	}
+
+	if err := limiter.setup(limitInfo); err != nil {
+		return nil, err
+	}
+	return limiter, nil
+}
+
+// NewLimiter is a factory method for creating a rate limiter that keeps its
+// state in redis, through the meshRedis pool, unless a store is given w/
+// WithStore. meshRedis is only needed when no store is given
+func NewLimiter(limitInfo *RateLimitInfo, opts ...Option) (*RateLimiter, error) {
+	limiter, err := newLimiter(nil, limitInfo, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := limiter.setDefaultStore(); err != nil {
+		return nil, err
+	}
+
+	if err := limiter.setup(limitInfo); err != nil {
+		return nil, err
+	}
+	return limiter, nil
+}
+
+// NewLimiterWithPool is a factory method for creating a rate limiter that
+// keeps its state in redis, through the given pool rather than the meshRedis
+// one. Limiters w/ different pools can target different redis instances
+func NewLimiterWithPool(pool meshRedis.RedPool, limitInfo *RateLimitInfo, opts ...Option) (*RateLimiter, error) {
 	if pool == nil {
-		return nil, fmt.Errorf("Failed to acquire Redis pool. Check that meshRedis is connected.")
+		return nil, errors.New("Unable to create the rate limiter. A Redis pool is required")
+	}
+	return NewLimiterWithStore(NewRedisStore(pool), limitInfo, opts...)
+}
+
+// NewLimiterWithPools is a factory method for creating a rate limiter that
+// keeps its state on several independent redis nodes, one for each pool.
+// Requests are only admitted when a quorum of the nodes agree
+func NewLimiterWithPools(pools []meshRedis.RedPool, limitInfo *RateLimitInfo, opts ...Option) (*RateLimiter, error) {
+	store, err := NewQuorumStore(pools...)
+	if err != nil {
+		return nil, err
+	}
+	return NewLimiterWithStore(store, limitInfo, opts...)
+}
+
+// NewLimiterWithStore is a factory method for creating a rate limiter that
+// keeps its state in the given store. A MemoryStore needs no redis at all,
+// but only limits the requests of a single process
+func NewLimiterWithStore(store Store, limitInfo *RateLimitInfo, opts ...Option) (*RateLimiter, error) {
+	if store == nil {
+		return nil, errors.New("Unable to create the rate limiter. A store is required")
+	}
+
+	limiter, err := newLimiter(store, limitInfo, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := limiter.setup(limitInfo); err != nil {
+		return nil, err
+	}
+	return limiter, nil
+}
+
+// newLimiter creates a rate limiter w/ the defaults, and applies the options
+// to it. The limiter must be setup before it is used
+func newLimiter(store Store, limitInfo *RateLimitInfo, opts []Option) (*RateLimiter, error) {
+	if !limitInfo.Strategy.valid() {
+		return nil, fmt.Errorf("Unknown rate limiting strategy: %d", limitInfo.Strategy)
 	}
 
 	// Append additional string on tag
-	limiterToken := limitInfo.Token + "_rateLimiterToken"
+	limiterToken := limitInfo.Token + limiterTokenSuffix
 	limiter := &RateLimiter{
+		store:                      store,
 		token:                      limiterToken,
 		timeInterval:               limitInfo.TimeInterval,
 		maxRequestsForTimeInterval: limitInfo.MaxRequests,
-		delay: limitInfo.TimeInterval / 4,
+		strategy:                   limitInfo.Strategy,
+		retries:                    defaultRetries,
+		delay:                      limitInfo.TimeInterval / 4,
+		factor:                     defaultFactor,
+		backoff:                    1,
+		logger:                     nopLogger{},
+		clock:                      systemClock{},
+		expectedReplicas:           1,
+		recoveryInterval:           defaultRecoveryInterval,
+		queuePoll:                  defaultQueuePoll,
+		degradation:                &degradation{local: NewMemoryStore()},
+	}
+
+	for _, opt := range opts {
+		if err := opt(limiter); err != nil {
+			return nil, err
+		}
 	}
-	limiter.mutex = &sync.Mutex{}
-	limiter.pool = pool
 	return limiter, nil
 }
 
-// Enter attempts to enter the request into the current pool
-func (r *RateLimiter) Enter() error {
+// setDefaultStore keeps the state of the limiter in redis, through the
+// meshRedis pool, when no store was given. A nested limiter shares the store
+// of its parent instead
+func (r *RateLimiter) setDefaultStore() error {
+	if r.store != nil {
+		return nil
+	}
 
-	// Set expiration
-	timeInterval := r.timeInterval
-	if timeInterval == 0 {
-		timeInterval = defaultTimeInterval
+	if r.parent != nil {
+		r.store = r.parent.store
+		return nil
 	}
 
-	// Set retries
-	retries := r.retries
-	if retries == 0 {
-		retries = defaultRetries
+	pool := meshRedis.UnderlyingPool()
+	if pool == nil {
+		return errors.New("Unable to create the rate limiter. Connect meshRedis, or give the limiter a store w/ WithStore")
 	}
+	r.store = NewRedisStore(pool)
+	return nil
+}
 
-	// Set delay
-	delay := r.delay
-	if delay == 0 {
-		delay = delay / 10.0
+// setup resolves what the strategy needs, once the options are applied, and
+// checks that the options go together
+func (r *RateLimiter) setup(limitInfo *RateLimitInfo) error {
+	if r.strategy == GCRA {
+		if err := r.setupGCRA(limitInfo); err != nil {
+			return err
+		}
 	}
 
-	// Set factor
-	factor := r.factor
-	if factor == 0 {
-		factor = defaultFactor
+	if len(r.rules) > 0 && r.strategy != SlidingWindowCounter {
+		return fmt.Errorf("Unable to create the composite limiter. Its rules are counted like the SlidingWindowCounter strategy, not the %s one", r.strategy)
 	}
 
-	// Local token ref
-	token := r.rateLimiterToken()
+	if r.parent != nil {
+		if err := r.setupParent(); err != nil {
+			return err
+		}
+	}
 
-	// Begin process of trying to enter into the
-	// current window on this process. Lock across this
-	// process to avoid rushing redis
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	if r.ticketTTL > 0 {
+		if err := r.setupFairQueue(); err != nil {
+			return err
+		}
+	}
 
-	// Lock this job across processes too, but only after a
-	// sequential local lock
-	redMutex := r.redMutexForTask(factor, delay)
-	err := redMutex.Lock()
-	if err != nil {
-		meshLog.Fatalf("Error acquiring local redlock on ratelimiter with error: %+v", token)
-		return err
+	if r.strategy == LeakyBucket && r.maxRequestsForTimeInterval <= 0 {
+		return errors.New("Unable to create the LeakyBucket limiter. A positive MaxRequests is required")
 	}
-	defer redMutex.Unlock()
 
-	// Create and close the redis connection we were handed
-	redisSession := meshRedis.NewSessionWithExistingPool(r.pool)
-	defer redisSession.CloseSession()
+	// Retry at a tenth of the window when there is no interval to go by
+	if r.delay == 0 {
+		r.delay = r.windowInterval() / 10
+		if r.delay < 1 {
+			r.delay = 1
+		}
+	}
 
-	// Enter a loop to begin the tries to enter the limiter group
-	for i := 0; i < retries; i++ {
-		// First try to resolve the list and get a count
-		count, err := redisSession.GetListCount(token)
-		if err != nil {
-			meshLog.Fatal(err)
+	if r.maxDelay > 0 && r.maxDelay < r.delay {
+		return fmt.Errorf("Unable to create the rate limiter. The max backoff of %dms is less than the retry delay of %dms", r.maxDelay, r.delay)
+	}
+
+	if _, ok := r.store.(*QuorumStore); r.lockExpiry > 0 && !ok {
+		return errors.New("Unable to create the rate limiter. A lock expiry only applies to a QuorumStore, which is the only store that takes a lock")
+	}
+	return nil
+}
+
+// setupGCRA resolves the rate and burst of the GCRA strategy
+func (r *RateLimiter) setupGCRA(limitInfo *RateLimitInfo) error {
+	rate := limitInfo.Rate
+	if rate == 0 && limitInfo.TimeInterval > 0 {
+		rate = float64(limitInfo.MaxRequests) * 1000 / float64(limitInfo.TimeInterval)
+	}
+	if rate <= 0 {
+		return errors.New("Unable to create the GCRA limiter. A positive Rate, or MaxRequests and TimeInterval, are required")
+	}
+
+	burst := limitInfo.Burst
+	if burst == 0 {
+		burst = limitInfo.MaxRequests
+	}
+	if burst <= 0 {
+		return errors.New("Unable to create the GCRA limiter. A positive Burst or MaxRequests is required")
+	}
+
+	r.emissionInterval = 1000 / rate
+	r.burst = burst
+
+	// Retry at about the pace requests are let through
+	if r.delay == 0 {
+		r.delay = int64(math.Ceil(r.emissionInterval))
+	}
+	return nil
+}
+
+// Enter attempts to enter the request into the current pool
+func (r *RateLimiter) Enter() error {
+	return r.EnterNContext(context.Background(), 1)
+}
+
+// EnterContext attempts to enter the request into the current pool, giving
+// up as soon as ctx is done. When ctx ends first, ctx.Err() is returned and
+// nothing is pushed into the limiter
+func (r *RateLimiter) EnterContext(ctx context.Context) error {
+	return r.EnterNContext(ctx, 1)
+}
+
+// EnterN attempts to enter a request that costs n units of the max requests
+// into the current pool. All n units are taken at once, or none are
+func (r *RateLimiter) EnterN(n int) error {
+	return r.EnterNContext(context.Background(), n)
+}
+
+// EnterNContext is like EnterN, but gives up as soon as ctx is done
+func (r *RateLimiter) EnterNContext(ctx context.Context, n int) error {
+	_, err := r.admitN(ctx, n)
+	return err
+}
+
+// admitN waits for room for n units in the limiter, giving up as soon as ctx
+// is done, and returns the admission
+func (r *RateLimiter) admitN(ctx context.Context, n int) (*Admission, error) {
+	if err := r.validateN(n); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Paced requests are handed a slot rather than retrying
+	if r.strategy == LeakyBucket {
+		return r.enterPaced(ctx, n)
+	}
+
+	// Fair waiters take a ticket, and only try for room in their turn
+	var ticket int64
+	defer func() { r.leave(ticket) }()
+
+	// Enter a loop to begin the tries to enter the limiter group. There
+	// is no locking, each attempt is a single atomic script in redis
+	var lastErr error
+	var denied TakeResult
+	var deniedAt int64
+	delay := r.delay
+	for i := 0; i < r.retries; {
+		// Last chance to back out before we take a spot in the list
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 
-		if err != nil || count >= r.maxRequestsForTimeInterval {
-			// Sleep w/ a randomness factor
-			sleepTime := (rand.Float64() * factor * float64(delay)) + float64(delay)
-			time.Sleep(time.Duration(sleepTime) * time.Millisecond)
-		} else {
-			// The key doesnt exists, or we're below our limit
-			//
-			// Check for the key existence
-			exists, err := redisSession.KeyExists(token)
-			if err != nil {
-				meshLog.Fatal(err)
-				continue
+		// Check the count and push in one step. Only the current
+		// window is of interest here
+		now := r.now()
+		woken := r.turns.wait()
+		result, ahead, err := r.takeInTurn(&ticket, n, now)
+		if ahead > 0 {
+			// Waiting behind other tickets doesn't use up an attempt
+			if err := r.waitForTurn(ctx, woken, ahead); err != nil {
+				return nil, err
 			}
+			continue
+		}
+		i++
 
-			// If key doesn't exist, push it w/ expiration
-			if !exists {
-				// Multi cmd
-				err = redisSession.AtomicPushOnListWithMsExpiration(token, token, timeInterval)
-				if err != nil {
-					meshLog.Fatalf("Block Creation Error In Rate Limiter: %+v", err)
-					continue
-				}
-			} else {
-				// RPush
-				_, err = redisSession.RPushX(token, token)
-				if err != nil {
-					meshLog.Fatal(err)
-					continue
-				}
-			}
+		if err != nil && r.failurePolicy == FailClosed {
+			return nil, err
+		}
+		if err == nil && result.Admitted {
 			// Success! Let's return w/ no error
-			return nil
+			return r.newAdmission(result, n, now), nil
+		}
+		if err == nil && result.Delay < 0 {
+			// The request can never fit, such as in the share of a
+			// degraded limiter, so there's no use in retrying
+			return nil, r.limitError(result, n, now)
 		}
+
+		// Sleep w/ a randomness factor. The first waiter of the queue
+		// only has to wait for the room the store reported instead
+		wait := jitter(r.factor, delay)
+		if ticket != 0 && err == nil {
+			wait = r.queueWait(time.Duration(result.Delay) * time.Millisecond)
+		}
+		fields := Fields{Token: r.key(), Attempt: i, Wait: wait, Err: err}
+		if err != nil {
+			r.logger.Error("Unable to reach the store of the rate limiter", fields)
+		} else {
+			denied, deniedAt = result, now
+			r.logger.Debug("Rate limiter is full, retrying", fields)
+		}
+		lastErr = err
+
+		if err := sleepContext(ctx, r.queueWait(wait)); err != nil {
+			return nil, err
+		}
+		delay = r.nextDelay(delay)
 	}
 
-	return errors.New("Unable to process request. Max attempts hit in the Rate Limiter")
+	// The store failing on the last attempt is not the limiter turning the
+	// request down
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, r.limitError(denied, n, deniedAt)
 }
 
-/**
- * Tokens
- */
+// enterPaced takes the next free slot for n requests and sleeps until it
+// comes. A slot further ahead than the max wait isn't taken, and the request
+// is turned down instead. If ctx is done first, the slot is given back when
+// no one has taken a slot after it
+func (r *RateLimiter) enterPaced(ctx context.Context, n int) (*Admission, error) {
+	now := r.now()
+	result, err := r.takeAt(n, r.pacedWait(), now)
+	if err != nil {
+		return nil, err
+	}
+	if !result.Admitted {
+		return nil, r.limitError(result, n, now)
+	}
+
+	err = sleepContext(ctx, time.Duration(result.Delay)*time.Millisecond)
+	if err != nil {
+		if result.Window != 0 {
+			if _, cancelErr := r.cancel(result.Window, result.ID, n); cancelErr != nil {
+				r.logger.Error("Unable to give back the slot of the rate limiter", Fields{Token: r.key(), Err: cancelErr})
+			}
+		}
+		return nil, err
+	}
+	return r.newAdmission(result, n, now), nil
+}
 
-// redlockTokenForToken is the token used for redlock
-func (r *RateLimiter) redlockToken() string {
-	return r.token + "_redSync"
+// TryEnter makes a single attempt to enter the request into the current pool
+// w/out blocking, and reports whether the request was admitted. Requests are
+// not admitted while waiters of a fair queue are queued
+func (r *RateLimiter) TryEnter() (bool, error) {
+	admitted, _, err := r.tryEnterN(1)
+	return admitted, err
 }
 
-// redlockTokenForToken is the token used for redlock
-func (r *RateLimiter) rateLimiterToken() string {
-	return r.token + "_rateLimiterToken"
+// TryEnterWithReset is like TryEnter, but when the request is not admitted it
+// also reports how long until the current window resets
+func (r *RateLimiter) TryEnterWithReset() (bool, time.Duration, error) {
+	return r.tryEnterN(1)
 }
 
-/**
- * Red Lock Mutex
- */
+// TryEnterWithLimit is like TryEnter, but when the request is not admitted it
+// also returns the LimitError that Enter would have, which names the limiter
+// that turned the request down and when to retry
+func (r *RateLimiter) TryEnterWithLimit() (bool, *LimitError, error) {
+	admission, limitErr, err := r.tryAdmitN(1)
+	return admission != nil, limitErr, err
+}
+
+// TryEnterN makes a single attempt to enter a request that costs n units of
+// the max requests into the current pool w/out blocking
+func (r *RateLimiter) TryEnterN(n int) (bool, error) {
+	admitted, _, err := r.tryEnterN(n)
+	return admitted, err
+}
+
+// tryEnterN makes a single attempt to take room for n units in the current
+// window, reporting how long until there is room when it is full
+func (r *RateLimiter) tryEnterN(n int) (bool, time.Duration, error) {
+	admission, limitErr, err := r.tryAdmitN(n)
+	if limitErr != nil {
+		return false, limitErr.RetryAfter, err
+	}
+	return admission != nil, 0, err
+}
+
+// tryAdmitN is like tryEnterN, but returns the admission, which is nil when
+// the request was not admitted, or the LimitError of the limiter that turned
+// it down
+func (r *RateLimiter) tryAdmitN(n int) (*Admission, *LimitError, error) {
+	if err := r.validateN(n); err != nil {
+		return nil, nil, err
+	}
 
-// redMutexForTask vendors a configured redlock w/ randomness builtin for the expiration
-// of the lock
-func (r *RateLimiter) redMutexForTask(factor float64, delay int64) *redsync.Mutex {
-	// Grab the pool
-	redisPool := r.pool
-	nodes := []redsync.Pool{redisPool}
+	now := r.now()
+	queued, err := r.queued(now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if queued {
+		// Waiters of the fair queue go first
+		wait := int64(r.queuePoll / time.Millisecond)
+		return nil, r.limitError(TakeResult{Delay: wait}, n, now), nil
+	}
 
-	// Generate the mutex w/ token
-	redSyncToken := r.redlockToken()
-	redMutex, err := redsync.NewMutexWithGenericPool(redSyncToken, nodes)
+	result, err := r.takeAt(n, 0, now)
 	if err != nil {
-		meshLog.Fatalf("Error creating RedMutex in limiter: %+v", err)
+		return nil, nil, err
+	}
+
+	if result.Admitted {
+		return r.newAdmission(result, n, now), nil, nil
+	}
+	return nil, r.limitError(result, n, now), nil
+}
+
+// limitError describes the request for n units the result turned down at
+// the given time, naming the level of a nested limiter that turned it down.
+// The room left is read from the store that turned it down, and is left at 0
+// when it can't be read
+func (r *RateLimiter) limitError(result TakeResult, n int, now int64) *LimitError {
+	deniedBy := r.ancestor(result.Level)
+	store, limit := deniedBy.store, deniedBy.limit()
+	if result.Degraded {
+		store, limit = r.degradation.local, deniedBy.localLimit()
+	}
+
+	remaining := 0
+	if usage, err := store.Status(limit, now); err == nil {
+		remaining = usage.Limit - usage.Used
+	}
+
+	// The room was too little for the request when it was turned down
+	if remaining >= n {
+		remaining = n - 1
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	retryAfter := time.Duration(result.Delay) * time.Millisecond
+	if result.Delay < 0 {
+		retryAfter = InfDuration
+	}
+	return &LimitError{
+		Key:        deniedBy.key(),
+		Limit:      deniedBy.capacity(),
+		Remaining:  remaining,
+		RetryAfter: retryAfter,
+	}
+}
+
+// validateN checks that a request costing n units could ever fit in a window
+func (r *RateLimiter) validateN(n int) error {
+	if n <= 0 {
+		return errors.New("Unable to process request. The amount of requests must be positive")
+	}
+	if n > r.capacity() {
+		return fmt.Errorf("Unable to process request. %d requests exceed the max of %d in the Rate Limiter", n, r.capacity())
+	}
+	for parent := r.parent; parent != nil; parent = parent.parent {
+		if n > parent.capacity() {
+			return fmt.Errorf("Unable to process request. %d requests exceed the max of %d in the parent %s of the Rate Limiter", n, parent.capacity(), parent.key())
+		}
+	}
+	return nil
+}
+
+// capacity returns the most requests that can ever be admitted at once
+func (r *RateLimiter) capacity() int {
+	if r.strategy == GCRA {
+		return r.burst
+	}
+	return r.maxRequestsForTimeInterval
+}
+
+// pacedWait returns the most time (in ms) Enter waits for a paced slot
+func (r *RateLimiter) pacedWait() int64 {
+	if r.maxWait > 0 {
+		return r.maxWait
+	}
+	return int64(r.retries) * r.delay
+}
+
+// nextDelay returns the delay to wait after the one that was just waited,
+// grown by the backoff
+func (r *RateLimiter) nextDelay(delay int64) int64 {
+	next := int64(math.Ceil(float64(delay) * r.backoff))
+	if r.maxDelay > 0 && next > r.maxDelay {
+		return r.maxDelay
+	}
+	return next
+}
+
+// key returns the token the limiter was created w/
+func (r *RateLimiter) key() string {
+	return strings.TrimSuffix(r.token, limiterTokenSuffix)
+}
+
+// windowInterval returns the time interval (in ms) for the window
+func (r *RateLimiter) windowInterval() int64 {
+	if r.timeInterval == 0 {
+		return defaultTimeInterval
+	}
+	return r.timeInterval
+}
+
+// limit describes the limiter to its store
+func (r *RateLimiter) limit() *Limit {
+	return &Limit{
+		Token:            r.token,
+		Strategy:         r.strategy,
+		MaxRequests:      r.maxRequestsForTimeInterval,
+		TimeInterval:     r.windowInterval(),
+		EmissionInterval: r.emissionInterval,
+		Burst:            r.burst,
+		KeyPrefix:        r.keyPrefix,
+		LockExpiry:       r.lockExpiry,
+		Rules:            r.rules,
+		Parent:           r.parentLimit(),
+	}
+}
+
+// parentLimit describes the parent of the limiter to its store, or is nil
+// when there is none
+func (r *RateLimiter) parentLimit() *Limit {
+	if r.parent == nil {
 		return nil
 	}
+	return r.parent.limit()
+}
 
-	// Configure the mutex to have add sleep time randomness to its waiting. It was
-	// found in testing that w/ out this, the system locks in step w/ itself when not using
-	// a local pmutex. This is a danger for dist systems
-	redMutex.Tries = 10000
+/**
+ * Sleep Helpers
+ */
+
+// jitter returns the delay (in ms) w/ a randomness factor applied
+func jitter(factor float64, delay int64) time.Duration {
 	sleepTime := (rand.Float64() * factor * float64(delay)) + float64(delay)
-	redMutex.Delay = time.Duration(sleepTime) * time.Millisecond
-	redMutex.Expiry = 15 * time.Second
-	return redMutex
+	return time.Duration(sleepTime) * time.Millisecond
+}
+
+// now returns the time (in ms) on the clock of the limiter
+func (r *RateLimiter) now() int64 {
+	return r.clock.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// nowInMilliseconds returns the current unix time in milliseconds
+func nowInMilliseconds() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// sleepContext sleeps for the duration, returning early w/ ctx.Err() if the
+// context is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
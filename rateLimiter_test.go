@@ -1,6 +1,7 @@
 package funnel
 
 import (
+	"context"
 	"flag"
 	"sync"
 	"sync/atomic"
@@ -58,6 +59,7 @@ func (r *RateLimiterTest) TestSuccessfulRateLimiting(c *C) {
 
 	rateLimiter, err := NewLimiter(limiterInfo)
 	c.Assert(err, IsNil)
+	clearLimiter(c, rateLimiter)
 
 	// Tracking Begin Time
 	beginTime := unixInMilliseconds()
@@ -110,6 +112,7 @@ func (r *RateLimiterTest) TestSuccessfulRateLimitingWithHigherNumOfOps(c *C) {
 	}
 
 	rateLimiter, _ := NewLimiter(limiterInfo)
+	clearLimiter(c, rateLimiter)
 
 	// Tracking Begin Time
 	beginTime := unixInMilliseconds()
@@ -153,14 +156,16 @@ func (r *RateLimiterTest) TestSuccessfulRateLimitingWithHigherNumOfOps(c *C) {
 // executed earlier than the allowed limit
 func (r *RateLimiterTest) TestRateLimitingDoesNotExceedRequestsInATimeInterval(c *C) {
 
-	// Max 10 Entires per second
+	// Max 10 Entires per second. The routines left waiting at the end
+	// use their own token so they don't spill into the other tests
 	limiterInfo := &RateLimitInfo{
-		Token:        "uniqueToken",
+		Token:        "exceedToken",
 		MaxRequests:  10,
 		TimeInterval: 1000,
 	}
 
 	rateLimiter, _ := NewLimiter(limiterInfo)
+	clearLimiter(c, rateLimiter)
 
 	// Sync the outcome
 	var successCount uint64
@@ -183,6 +188,201 @@ func (r *RateLimiterTest) TestRateLimitingDoesNotExceedRequestsInATimeInterval(c
 	c.Assert(successCount < totalCount, Equals, true)
 }
 
+//---------
+// Test Context Cancellation
+//---------
+
+// TestEnterContextAbortsWhenDeadlineExceeded tests that a caller waiting on a
+// full limiter gives up once its context is done and leaves no entry behind
+func (r *RateLimiterTest) TestEnterContextAbortsWhenDeadlineExceeded(c *C) {
+
+	// Max 5 Entries per two seconds
+	limiterInfo := &RateLimitInfo{
+		Token:        "contextToken",
+		MaxRequests:  5,
+		TimeInterval: 2000,
+	}
+
+	rateLimiter, err := NewLimiter(limiterInfo)
+	c.Assert(err, IsNil)
+	clearLimiter(c, rateLimiter)
+
+	// Fill the window
+	for i := 0; i < 5; i++ {
+		c.Assert(rateLimiter.Enter(), IsNil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	beginTime := unixInMilliseconds()
+	err = rateLimiter.EnterContext(ctx)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	// We should have bailed well before the window expired
+	totalTime := unixInMilliseconds() - beginTime
+	c.Assert(totalTime < 1000, Equals, true)
+	c.Assert(listCount(c, rateLimiter), Equals, 5)
+}
+
+// TestEnterContextWithCancelledContext tests that an already cancelled context
+// never enters the limiter
+func (r *RateLimiterTest) TestEnterContextWithCancelledContext(c *C) {
+	limiterInfo := &RateLimitInfo{
+		Token:        "cancelledToken",
+		MaxRequests:  5,
+		TimeInterval: 1000,
+	}
+
+	rateLimiter, err := NewLimiter(limiterInfo)
+	c.Assert(err, IsNil)
+	clearLimiter(c, rateLimiter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = rateLimiter.EnterContext(ctx)
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(listCount(c, rateLimiter), Equals, 0)
+}
+
+//---------
+// Test Non-Blocking Entry
+//---------
+
+// TestTryEnterAdmitsUntilFull tests that TryEnter admits requests while there
+// is room in the window, and reports the reset time once it is full
+func (r *RateLimiterTest) TestTryEnterAdmitsUntilFull(c *C) {
+	limiterInfo := &RateLimitInfo{
+		Token:        "tryEnterToken",
+		MaxRequests:  3,
+		TimeInterval: 1000,
+	}
+
+	rateLimiter, err := NewLimiter(limiterInfo)
+	c.Assert(err, IsNil)
+	clearLimiter(c, rateLimiter)
+
+	for i := 0; i < 3; i++ {
+		admitted, err := rateLimiter.TryEnter()
+		c.Assert(err, IsNil)
+		c.Assert(admitted, Equals, true)
+	}
+
+	beginTime := unixInMilliseconds()
+	admitted, reset, err := rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(reset > 0, Equals, true)
+	c.Assert(reset <= time.Second, Equals, true)
+
+	// Returning is immediate
+	c.Assert(unixInMilliseconds()-beginTime < 100, Equals, true)
+	c.Assert(listCount(c, rateLimiter), Equals, 3)
+
+	// Once the window resets there is room again
+	time.Sleep(reset + 50*time.Millisecond)
+	admitted, err = rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+}
+
+//---------
+// Test Weighted Entry
+//---------
+
+// TestEnterNTakesAllUnits tests that weighted requests take all of their
+// units at once, or none of them
+func (r *RateLimiterTest) TestEnterNTakesAllUnits(c *C) {
+	limiterInfo := &RateLimitInfo{
+		Token:        "enterNToken",
+		MaxRequests:  5,
+		TimeInterval: 1000,
+	}
+
+	rateLimiter, err := NewLimiter(limiterInfo)
+	c.Assert(err, IsNil)
+	clearLimiter(c, rateLimiter)
+
+	c.Assert(rateLimiter.EnterN(3), IsNil)
+	c.Assert(listCount(c, rateLimiter), Equals, 3)
+
+	admitted, err := rateLimiter.TryEnterN(3)
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(listCount(c, rateLimiter), Equals, 3)
+
+	admitted, err = rateLimiter.TryEnterN(2)
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+	c.Assert(listCount(c, rateLimiter), Equals, 5)
+}
+
+// TestEnterNWaitsForRoom tests that a weighted request blocks until a window
+// has room for all of its units
+func (r *RateLimiterTest) TestEnterNWaitsForRoom(c *C) {
+	limiterInfo := &RateLimitInfo{
+		Token:        "enterNWaitToken",
+		MaxRequests:  5,
+		TimeInterval: 1000,
+	}
+
+	rateLimiter, err := NewLimiter(limiterInfo)
+	c.Assert(err, IsNil)
+	clearLimiter(c, rateLimiter)
+
+	c.Assert(rateLimiter.EnterN(4), IsNil)
+
+	beginTime := unixInMilliseconds()
+	c.Assert(rateLimiter.EnterN(2), IsNil)
+	totalTime := unixInMilliseconds() - beginTime
+	c.Assert(totalTime > 500, Equals, true)
+	c.Assert(listCount(c, rateLimiter), Equals, 2)
+}
+
+// TestEnterNExceedingMax tests that a request costing more than the max is
+// rejected right away instead of blocking forever
+func (r *RateLimiterTest) TestEnterNExceedingMax(c *C) {
+	limiterInfo := &RateLimitInfo{
+		Token:        "enterNMaxToken",
+		MaxRequests:  5,
+		TimeInterval: 1000,
+	}
+
+	rateLimiter, err := NewLimiter(limiterInfo)
+	c.Assert(err, IsNil)
+	clearLimiter(c, rateLimiter)
+
+	beginTime := unixInMilliseconds()
+	err = rateLimiter.EnterN(6)
+	c.Assert(err, ErrorMatches, ".*6 requests exceed the max of 5.*")
+	c.Assert(unixInMilliseconds()-beginTime < 100, Equals, true)
+
+	_, err = rateLimiter.TryEnterN(0)
+	c.Assert(err, NotNil)
+	c.Assert(listCount(c, rateLimiter), Equals, 0)
+}
+
+/**
+ * Redis helpers
+ */
+
+// clearLimiter removes any state left in redis for the limiter
+func clearLimiter(c *C, limiter *RateLimiter) {
+	session := meshRedis.NewSession()
+	defer session.CloseSession()
+	c.Assert(session.Delete(limiter.limit().rateLimiterToken()), IsNil)
+}
+
+// listCount returns the amount of entries in the limiter's current window
+func listCount(c *C, limiter *RateLimiter) int {
+	session := meshRedis.NewSession()
+	defer session.CloseSession()
+	count, err := session.GetListCount(limiter.limit().rateLimiterToken())
+	c.Assert(err, IsNil)
+	return count
+}
+
 /**
  * Mini time helper
  */
@@ -0,0 +1,327 @@
+package funnel
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/meshhq/meshRedis"
+)
+
+// RedisStore keeps the state of rate limiters in redis, so that it is shared
+// by every process using the same token. Each call is a single Lua script.
+// W/ a ClusterPool, each script runs on the node serving the token. The
+// scripts measure time on the clock of the caller, so the clocks of the hosts
+// sharing a limiter must be kept in sync, since a host whose clock is ahead
+// admits requests that much early
+type RedisStore struct {
+	// pool is a reference to a struct that vendors a redigo connection
+	pool meshRedis.RedPool
+}
+
+// NewRedisStore is a factory method for creating a store backed by the pool
+func NewRedisStore(pool meshRedis.RedPool) *RedisStore {
+	return &RedisStore{pool: pool}
+}
+
+// Take runs the strategy's script to take room for n requests in the
+// limiter. This is a single round trip to redis
+func (s *RedisStore) Take(limit *Limit, n int, now int64, wait int64) (TakeResult, error) {
+	var id string
+	if len(limit.Rules) == 0 && limit.Strategy.tracksEntries() {
+		id = newEntryID()
+	}
+	return s.takeWithID(limit, id, n, now, wait)
+}
+
+// takeWithID is like Take, but the entries of the take are given the id
+// rather than a new one
+func (s *RedisStore) takeWithID(limit *Limit, id string, n int, now int64, wait int64) (TakeResult, error) {
+	result := TakeResult{ID: id}
+
+	reply, err := redis.Values(runOnKey(s.pool, limit.rateLimiterToken(), func(conn redis.Conn) (interface{}, error) {
+		if limit.Parent != nil {
+			return evalScript(conn, hierarchyScript, limit.hierarchyArgs(n, now)...)
+		}
+		if len(limit.Rules) > 0 {
+			return evalScript(conn, compositeScript, limit.compositeArgs(n, now)...)
+		}
+
+		switch limit.Strategy {
+		case LeakyBucket:
+			return evalScript(conn, leakyBucketScript, limit.leakyBucketToken(),
+				limit.slotSpacing(), n, now, wait)
+		case GCRA:
+			return evalScript(conn, gcraScript, limit.gcraToken(),
+				limit.EmissionInterval, limit.Burst, n, now, wait)
+		case SlidingWindowCounter:
+			return evalScript(conn, slidingCounterScript, limit.slidingCounterToken(),
+				limit.MaxRequests, limit.TimeInterval, n, now)
+		case SlidingLog:
+			return evalScript(conn, slidingLogScript, limit.slidingLogToken(), result.ID,
+				limit.MaxRequests, limit.TimeInterval, n, now, wait)
+		}
+		return evalScript(conn, fixedWindowScript, limit.rateLimiterToken(), limit.reservationsToken(), result.ID,
+			limit.MaxRequests, limit.TimeInterval, n, now, wait)
+	}))
+	if err != nil {
+		return TakeResult{}, err
+	}
+
+	var admitted int64
+	level, err := redis.Scan(reply, &admitted, &result.Delay, &result.Window)
+	if err != nil {
+		return TakeResult{}, err
+	}
+	if len(level) > 0 {
+		if _, err := redis.Scan(level, &result.Level); err != nil {
+			return TakeResult{}, err
+		}
+	}
+	result.Admitted = admitted == 1
+	return result, nil
+}
+
+// Cancel runs the strategy's script to give back the room for n requests
+// that was reserved at window
+func (s *RedisStore) Cancel(limit *Limit, window int64, id string, n int, now int64) (bool, error) {
+	return redis.Bool(runOnKey(s.pool, limit.rateLimiterToken(), func(conn redis.Conn) (interface{}, error) {
+		switch limit.Strategy {
+		case LeakyBucket:
+			return evalScript(conn, leakyBucketCancelScript, limit.leakyBucketToken(), limit.slotSpacing(), n, window, now)
+		case GCRA:
+			return evalScript(conn, gcraCancelScript, limit.gcraToken(), limit.EmissionInterval, n, window, now)
+		case SlidingLog:
+			return evalScript(conn, slidingLogCancelScript, limit.slidingLogToken(), id, n, window, now)
+		}
+		return evalScript(conn, fixedWindowCancelScript, limit.reservationsToken(), window, n, now)
+	}))
+}
+
+// Refund runs the strategy's script to give back the room for n requests
+// that was taken at the time at, as long as its window hasn't rolled over
+func (s *RedisStore) Refund(limit *Limit, at int64, id string, n int, now int64) (bool, error) {
+	if len(limit.Rules) == 0 && limit.Strategy == LeakyBucket {
+		return false, nil
+	}
+
+	return redis.Bool(runOnKey(s.pool, limit.rateLimiterToken(), func(conn redis.Conn) (interface{}, error) {
+		if limit.Parent != nil {
+			return evalScript(conn, hierarchyRefundScript, limit.hierarchyRefundArgs(at, n, now)...)
+		}
+		if len(limit.Rules) > 0 {
+			return evalScript(conn, counterRefundScript, limit.counterRefundArgs(at, n, now)...)
+		}
+
+		switch limit.Strategy {
+		case GCRA:
+			return evalScript(conn, gcraRefundScript, limit.gcraToken(), limit.EmissionInterval, limit.Burst, n, at, now)
+		case SlidingWindowCounter:
+			return evalScript(conn, counterRefundScript, limit.counterRefundArgs(at, n, now)...)
+		case SlidingLog:
+			return evalScript(conn, slidingLogRefundScript, limit.slidingLogToken(), id, n, limit.TimeInterval, now)
+		}
+
+		// The list only holds the entries of the current window, so the
+		// entries of a window that rolled over are already gone
+		return conn.Do("LREM", limit.rateLimiterToken(), n, id)
+	}))
+}
+
+// Status reads the state of the limiter, and reports how much of it is used
+func (s *RedisStore) Status(limit *Limit, now int64) (Usage, error) {
+	var usage Usage
+	_, err := runOnKey(s.pool, limit.rateLimiterToken(), func(conn redis.Conn) (interface{}, error) {
+		var err error
+		usage, err = readUsage(conn, limit, now)
+		return nil, err
+	})
+	return usage, err
+}
+
+// Enqueue runs the queueEnqueueScript to hand out the next ticket of the
+// limiter
+func (s *RedisStore) Enqueue(limit *Limit, now int64, ttl int64) (int64, error) {
+	return redis.Int64(runOnKey(s.pool, limit.rateLimiterToken(), func(conn redis.Conn) (interface{}, error) {
+		return evalScript(conn, queueEnqueueScript, limit.ticketsToken(), limit.queueToken(), limit.queueLeasesToken(), now, ttl)
+	}))
+}
+
+// Turn runs the queueTurnScript to renew the ticket, and counts the tickets
+// ahead of it
+func (s *RedisStore) Turn(limit *Limit, ticket int64, now int64, ttl int64) (int64, error) {
+	return redis.Int64(runOnKey(s.pool, limit.rateLimiterToken(), func(conn redis.Conn) (interface{}, error) {
+		return evalScript(conn, queueTurnScript, limit.queueToken(), limit.queueLeasesToken(), ticket, now, ttl)
+	}))
+}
+
+// Waiting runs the queueWaitingScript to count the tickets in the queue
+func (s *RedisStore) Waiting(limit *Limit, now int64) (int64, error) {
+	return redis.Int64(runOnKey(s.pool, limit.rateLimiterToken(), func(conn redis.Conn) (interface{}, error) {
+		return evalScript(conn, queueWaitingScript, limit.queueToken(), limit.queueLeasesToken(), now)
+	}))
+}
+
+// Leave runs the queueLeaveScript to remove the ticket from the queue
+func (s *RedisStore) Leave(limit *Limit, ticket int64) error {
+	_, err := runOnKey(s.pool, limit.rateLimiterToken(), func(conn redis.Conn) (interface{}, error) {
+		return evalScript(conn, queueLeaveScript, limit.queueToken(), limit.queueLeasesToken(), ticket)
+	})
+	return err
+}
+
+// readUsage reads the keys of the strategy w/ plain commands, since nothing
+// is written
+func readUsage(conn redis.Conn, limit *Limit, now int64) (Usage, error) {
+	if len(limit.Rules) > 0 {
+		counters, err := redis.IntMap(conn.Do("HGETALL", limit.compositeToken()))
+		if err != nil {
+			return Usage{}, err
+		}
+		return compositeUsage(limit.Rules, func(interval int64, window int64) int {
+			return counters[fmt.Sprintf("%d:%d", interval, window)]
+		}, now), nil
+	}
+
+	switch limit.Strategy {
+	case LeakyBucket:
+		nextSlot, err := redis.Float64(conn.Do("GET", limit.leakyBucketToken()))
+		if err != nil && err != redis.ErrNil {
+			return Usage{}, err
+		}
+		return leakyBucketUsage(limit, nextSlot, now), nil
+	case GCRA:
+		tat, err := redis.Float64(conn.Do("GET", limit.gcraToken()))
+		if err != nil && err != redis.ErrNil {
+			return Usage{}, err
+		}
+		return gcraUsage(limit, tat, now), nil
+	case SlidingWindowCounter:
+		window := now / limit.TimeInterval
+		counters, err := redis.Ints(conn.Do("HMGET", limit.slidingCounterToken(), window, window-1))
+		if err != nil {
+			return Usage{}, err
+		}
+		return slidingCounterUsage(limit.MaxRequests, limit.TimeInterval, counters[0], counters[1], now), nil
+	case SlidingLog:
+		// Entries that left the rolling interval are only dropped on a take
+		since := fmt.Sprintf("(%d", now-limit.TimeInterval)
+		count, err := redis.Int(conn.Do("ZCOUNT", limit.slidingLogToken(), since, "+inf"))
+		if err != nil {
+			return Usage{}, err
+		}
+		entry, err := redis.Values(conn.Do("ZRANGEBYSCORE", limit.slidingLogToken(), since, "+inf", "WITHSCORES", "LIMIT", 0, 1))
+		if err != nil {
+			return Usage{}, err
+		}
+		if len(entry) < 2 {
+			return slidingLogUsage(limit, 0, 0, now), nil
+		}
+		oldest, err := redis.Int64(entry[1], nil)
+		if err != nil {
+			return Usage{}, err
+		}
+		return slidingLogUsage(limit, count, oldest, now), nil
+	}
+
+	count, err := redis.Int(conn.Do("LLEN", limit.rateLimiterToken()))
+	if err != nil {
+		return Usage{}, err
+	}
+	ttl, err := redis.Int64(conn.Do("PTTL", limit.rateLimiterToken()))
+	if err != nil {
+		return Usage{}, err
+	}
+	return fixedWindowUsage(limit, count, ttl, now), nil
+}
+
+/**
+ * Connections
+ */
+
+// routedPool is a pool that picks the node to run commands on itself, and
+// follows its backend when the node serving a key changes
+type routedPool interface {
+	run(key string, f func(redis.Conn) (interface{}, error)) (interface{}, error)
+}
+
+// runOnKey runs f on a connection from the pool for commands on key. A
+// ClusterPool routes it to the node serving the key, and a SentinelPool to
+// the current master
+func runOnKey(pool meshRedis.RedPool, key string, f func(redis.Conn) (interface{}, error)) (interface{}, error) {
+	if routed, ok := pool.(routedPool); ok {
+		return routed.run(key, f)
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+	return f(conn)
+}
+
+/**
+ * Tokens
+ *
+ * Every key shares the hash tag of the token, so that the scripts touching
+ * several of them work on redis cluster. The key prefix goes ahead of the tag
+ */
+
+// rateLimiterToken is the token used for the list of the current window
+func (l *Limit) rateLimiterToken() string {
+	return l.KeyPrefix + hashTag(l.Token) + "_rateLimiterToken"
+}
+
+// reservationsToken is the token used for the windows reserved ahead of time
+func (l *Limit) reservationsToken() string {
+	return l.KeyPrefix + hashTag(l.Token) + "_reservations"
+}
+
+// slidingLogToken is the token used for the log of the SlidingLog strategy
+func (l *Limit) slidingLogToken() string {
+	return l.KeyPrefix + hashTag(l.Token) + "_slidingLog"
+}
+
+// leakyBucketToken is the token used for the next free slot of the
+// LeakyBucket strategy
+func (l *Limit) leakyBucketToken() string {
+	return l.KeyPrefix + hashTag(l.Token) + "_leakyBucket"
+}
+
+// gcraToken is the token used for the theoretical arrival time of the GCRA
+// strategy
+func (l *Limit) gcraToken() string {
+	return l.KeyPrefix + hashTag(l.Token) + "_gcra"
+}
+
+// slidingCounterToken is the token used for the counters of the
+// SlidingWindowCounter strategy
+func (l *Limit) slidingCounterToken() string {
+	return l.KeyPrefix + hashTag(l.Token) + "_slidingCounter"
+}
+
+// compositeToken is the token used for the counters of every rule of a
+// composite limiter
+func (l *Limit) compositeToken() string {
+	return l.KeyPrefix + hashTag(l.Token) + "_composite"
+}
+
+// ticketsToken is the token used for the sequence of the tickets of the fair
+// queue
+func (l *Limit) ticketsToken() string {
+	return l.KeyPrefix + hashTag(l.Token) + "_tickets"
+}
+
+// queueToken is the token used for the tickets waiting in the fair queue,
+// ordered by their number
+func (l *Limit) queueToken() string {
+	return l.KeyPrefix + hashTag(l.Token) + "_queue"
+}
+
+// queueLeasesToken is the token used for the time each ticket of the fair
+// queue is held until
+func (l *Limit) queueLeasesToken() string {
+	return l.KeyPrefix + hashTag(l.Token) + "_queueLeases"
+}
+
+// lockToken is the token used for the lock a QuorumStore takes on the limiter
+func (l *Limit) lockToken() string {
+	return l.KeyPrefix + hashTag(l.Token) + "_redlock"
+}
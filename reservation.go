@@ -0,0 +1,151 @@
+package funnel
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// InfDuration is the duration returned by Delay when a Reservation is not OK
+const InfDuration = time.Duration(1<<63 - 1)
+
+// Reservation holds room in the limiter that was taken ahead of time. The
+// room may be in the current window or in an upcoming one, in which case
+// the holder should wait for Delay before acting
+type Reservation struct {
+	// ok is whether the limiter could grant the reservation
+	ok bool
+
+	// limiter is the limiter the room was taken in
+	limiter *RateLimiter
+
+	// tokens is the amount of requests the room was taken for
+	tokens int
+
+	// timeToAct is the time at which the reserved room can be used
+	timeToAct time.Time
+
+	// window is the time (in ms) the room was reserved at in an upcoming
+	// window, or 0 for the current window
+	window int64
+
+	// id identifies the reserved entries, when the strategy tracks them
+	// individually
+	id string
+
+	// at is the time (in ms) the room was taken at
+	at int64
+
+	// degraded is whether the room was taken under the failure policy, and
+	// so was never counted by the store
+	degraded bool
+
+	// mutex guards whether the reservation is OK, which Cancel changes
+	mutex sync.Mutex
+}
+
+// Reserve is shorthand for ReserveN(1)
+func (r *RateLimiter) Reserve() (*Reservation, error) {
+	return r.ReserveN(1)
+}
+
+// ReserveN takes room for n requests in the first window that has it, be it
+// the current window or an upcoming one. The room is recorded in redis so
+// that it is honored by every process using the limiter. The Reservation is
+// not OK when n exceeds the max requests of a window, or while waiters of a
+// fair queue are queued. Reservations are not supported by the
+// SlidingWindowCounter strategy
+func (r *RateLimiter) ReserveN(n int) (*Reservation, error) {
+	if n <= 0 {
+		return nil, errors.New("Unable to process request. The amount of requests must be positive")
+	}
+	if !r.strategy.reservable() {
+		return nil, fmt.Errorf("Unable to reserve. The %s strategy doesn't support reservations", r.strategy)
+	}
+
+	now := r.clock.Now()
+	at := r.now()
+	queued, err := r.queued(at)
+	if err != nil {
+		return nil, err
+	}
+	if queued {
+		// Waiters of the fair queue go first
+		return &Reservation{limiter: r, tokens: n}, nil
+	}
+
+	result, err := r.takeAt(n, -1, at)
+	if err != nil {
+		return nil, err
+	}
+
+	if !result.Admitted {
+		return &Reservation{limiter: r, tokens: n}, nil
+	}
+
+	return &Reservation{
+		ok:        true,
+		limiter:   r,
+		tokens:    n,
+		timeToAct: now.Add(time.Duration(result.Delay) * time.Millisecond),
+		window:    result.Window,
+		id:        result.ID,
+		at:        at,
+		degraded:  result.Degraded,
+	}, nil
+}
+
+// OK returns whether the limiter could grant the reservation
+func (r *Reservation) OK() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.ok
+}
+
+// Delay is shorthand for DelayFrom the current time, on the clock of the
+// limiter
+func (r *Reservation) Delay() time.Duration {
+	return r.DelayFrom(r.limiter.clock.Now())
+}
+
+// DelayFrom returns the duration the holder must wait, from t, before acting
+// on the reservation. InfDuration is returned when the reservation is not OK
+func (r *Reservation) DelayFrom(t time.Time) time.Duration {
+	if !r.OK() {
+		return InfDuration
+	}
+
+	delay := r.timeToAct.Sub(t)
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// Cancel gives the reserved room back to the limiter so that others can use
+// it. Room in an upcoming window is given back as long as the window hasn't
+// begun, and room in the current window like a refund, as long as the window
+// hasn't rolled over. Otherwise Cancel does nothing. Cancelling from several
+// goroutines at once gives the room back once
+func (r *Reservation) Cancel() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.ok || r.degraded {
+		return nil
+	}
+
+	var err error
+	if r.window == 0 {
+		_, err = r.limiter.refund(r.at, r.id, r.tokens)
+	} else {
+		_, err = r.limiter.cancel(r.window, r.id, r.tokens)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The room can only be given back once
+	r.ok = false
+	return nil
+}
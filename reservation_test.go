@@ -0,0 +1,188 @@
+package funnel
+
+import (
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/meshhq/meshRedis"
+	. "gopkg.in/check.v1"
+)
+
+type ReservationTest struct{}
+
+var _ = Suite(&ReservationTest{})
+
+func (r *ReservationTest) SetUpSuite(c *C) {
+	err := meshRedis.SetupRedis()
+	c.Assert(err, Equals, nil)
+}
+
+func (r *ReservationTest) TearDownSuite(c *C) {
+	err := meshRedis.ClosePool()
+	c.Assert(err, Equals, nil)
+}
+
+// newReservationLimiter creates a cleared limiter for the reservation tests
+func newReservationLimiter(c *C, token string, max int) *RateLimiter {
+	limiterInfo := &RateLimitInfo{
+		Token:        token,
+		MaxRequests:  max,
+		TimeInterval: 1000,
+	}
+
+	rateLimiter, err := NewLimiter(limiterInfo)
+	c.Assert(err, IsNil)
+	clearLimiter(c, rateLimiter)
+
+	session := meshRedis.NewSession()
+	defer session.CloseSession()
+	c.Assert(session.Delete(rateLimiter.limit().reservationsToken()), IsNil)
+	return rateLimiter
+}
+
+//---------
+// Test Reserving
+//---------
+
+// TestReserveInCurrentWindow tests that a reservation is granted w/out delay
+// while there is room in the current window
+func (r *ReservationTest) TestReserveInCurrentWindow(c *C) {
+	rateLimiter := newReservationLimiter(c, "reserveCurrentToken", 2)
+
+	reservation, err := rateLimiter.ReserveN(2)
+	c.Assert(err, IsNil)
+	c.Assert(reservation.OK(), Equals, true)
+	c.Assert(reservation.Delay(), Equals, time.Duration(0))
+	c.Assert(listCount(c, rateLimiter), Equals, 2)
+}
+
+// TestReserveInUpcomingWindows tests that reservations spill over into the
+// upcoming windows once the current window is full
+func (r *ReservationTest) TestReserveInUpcomingWindows(c *C) {
+	rateLimiter := newReservationLimiter(c, "reserveUpcomingToken", 2)
+
+	_, err := rateLimiter.ReserveN(2)
+	c.Assert(err, IsNil)
+
+	// Both of these land in the next window
+	first, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	second, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(first.OK(), Equals, true)
+	c.Assert(second.OK(), Equals, true)
+	c.Assert(first.Delay() > 0, Equals, true)
+	c.Assert(first.Delay() <= time.Second, Equals, true)
+	c.Assert(second.window, Equals, first.window)
+
+	// And this one in the window after
+	third, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(third.window, Equals, first.window+1000)
+	c.Assert(third.Delay() > time.Second, Equals, true)
+}
+
+// TestReserveMoreThanMax tests that a reservation that can never fit in a
+// window is not OK
+func (r *ReservationTest) TestReserveMoreThanMax(c *C) {
+	rateLimiter := newReservationLimiter(c, "reserveMaxToken", 2)
+
+	reservation, err := rateLimiter.ReserveN(3)
+	c.Assert(err, IsNil)
+	c.Assert(reservation.OK(), Equals, false)
+	c.Assert(reservation.Delay(), Equals, InfDuration)
+	c.Assert(listCount(c, rateLimiter), Equals, 0)
+}
+
+// TestReservedRoomIsHonored tests that room reserved in an upcoming window is
+// not handed out again once that window begins
+func (r *ReservationTest) TestReservedRoomIsHonored(c *C) {
+	rateLimiter := newReservationLimiter(c, "reserveHonoredToken", 1)
+
+	admitted, err := rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+
+	reservation, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(reservation.OK(), Equals, true)
+
+	time.Sleep(reservation.Delay() + 50*time.Millisecond)
+	admitted, err = rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(listCount(c, rateLimiter), Equals, 1)
+}
+
+//---------
+// Test Cancelling
+//---------
+
+// TestCancelGivesBackRoom tests that cancelling a reservation in an upcoming
+// window lets another caller take its place
+func (r *ReservationTest) TestCancelGivesBackRoom(c *C) {
+	rateLimiter := newReservationLimiter(c, "reserveCancelToken", 1)
+
+	_, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+
+	reservation, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(reservation.Cancel(), IsNil)
+	c.Assert(reservation.OK(), Equals, false)
+
+	// The room in the next window is free again
+	replacement, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(replacement.window, Equals, reservation.window)
+}
+
+// TestCancelInCurrentWindow tests that cancelling a reservation in the
+// current window gives its room back as well
+func (r *ReservationTest) TestCancelInCurrentWindow(c *C) {
+	rateLimiter := newReservationLimiter(c, "reserveCancelCurrentToken", 2)
+
+	reservation, err := rateLimiter.ReserveN(2)
+	c.Assert(err, IsNil)
+	c.Assert(reservation.window, Equals, int64(0))
+	c.Assert(listCount(c, rateLimiter), Equals, 2)
+
+	c.Assert(reservation.Cancel(), IsNil)
+	c.Assert(reservation.OK(), Equals, false)
+	c.Assert(listCount(c, rateLimiter), Equals, 0)
+}
+
+// TestConcurrentCancelGivesBackRoomOnce tests that a reservation cancelled
+// from several goroutines at once only gives its room back once
+func (r *ReservationTest) TestConcurrentCancelGivesBackRoomOnce(c *C) {
+	rateLimiter := newReservationLimiter(c, "reserveConcurrentCancelToken", 2)
+
+	_, err := rateLimiter.ReserveN(2)
+	c.Assert(err, IsNil)
+	reservation, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	_, err = rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(reservation.Cancel(), IsNil)
+		}()
+	}
+	wg.Wait()
+	c.Assert(reservation.OK(), Equals, false)
+
+	// Only the room of the cancelled reservation is free in the next window
+	replacement, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(replacement.window, Equals, reservation.window)
+
+	later, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(later.window > reservation.window, Equals, true)
+}
@@ -0,0 +1,940 @@
+package funnel
+
+import (
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// evalScript runs the script by its SHA w/ EVALSHA. When redis doesn't know
+// the script yet, it is loaded w/ SCRIPT LOAD and run by its SHA again, so
+// the source is only ever sent to redis once per server
+func evalScript(conn redis.Conn, script *redis.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	reply, err := evalSHA(conn, script, keysAndArgs...)
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		if err := script.Load(conn); err != nil {
+			return nil, err
+		}
+		return evalSHA(conn, script, keysAndArgs...)
+	}
+	return reply, err
+}
+
+// evalSHA sends a single EVALSHA for the script and waits for its reply
+func evalSHA(conn redis.Conn, script *redis.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	if err := script.SendHash(conn, keysAndArgs...); err != nil {
+		return nil, err
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	return conn.Receive()
+}
+
+// fixedWindowScript takes room for n requests in the limiter in a single step.
+//
+// The current window is a list that expires interval ms after it is created.
+// Room in upcoming windows can be reserved ahead of time, in which case the
+// count is kept in a hash keyed by the start of the window (in ms). When the
+// current window expires, the next one adopts the count reserved for it so
+// that reserved requests are honored by everyone entering the limiter.
+//
+// KEYS[1] - the window list
+// KEYS[2] - the reservations hash
+// ARGV[1] - the id of the take, pushed once for each request
+// ARGV[2] - the max requests for a window
+// ARGV[3] - the time interval (in ms) of a window
+// ARGV[4] - the amount of requests to take room for
+// ARGV[5] - the current time (in ms)
+// ARGV[6] - the max time (in ms) to wait for an upcoming window, or -1 for any
+//
+// Returns {1, delay, window start} when room was taken, where the start is 0
+// for the current window. Otherwise returns {0, delay until there is room, 0},
+// with a delay of -1 when the request can never fit in a window
+var fixedWindowScript = redis.NewScript(2, `
+local max = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local now = tonumber(ARGV[5])
+local wait = tonumber(ARGV[6])
+
+if n > max then
+	return {0, -1, 0}
+end
+
+-- Forget the reserved windows that have passed. What is left is a chain of
+-- windows, interval ms apart, starting w/ the earliest one
+local chain = nil
+local buckets = redis.call("hgetall", KEYS[2])
+for i = 1, #buckets, 2 do
+	local start = tonumber(buckets[i])
+	if start + interval <= now then
+		redis.call("hdel", KEYS[2], buckets[i])
+	elseif chain == nil or start < chain then
+		chain = start
+	end
+end
+
+local count = redis.call("llen", KEYS[1])
+local expiry = interval
+if count == 0 and chain ~= nil then
+	if chain <= now then
+		-- A reserved window has begun, it becomes the current window
+		local field = string.format("%d", chain)
+		local reserved = tonumber(redis.call("hget", KEYS[2], field))
+		expiry = chain + interval - now
+		for i = 1, reserved do
+			redis.call("rpush", KEYS[1], "reserved")
+		end
+		if reserved > 0 then
+			redis.call("pexpire", KEYS[1], expiry)
+		end
+		redis.call("hdel", KEYS[2], field)
+		count = reserved
+		chain = chain + interval
+	elseif chain < now + interval then
+		-- A new window can't run into a reserved one
+		expiry = chain - now
+	end
+end
+
+if count + n <= max then
+	for i = 1, n do
+		redis.call("rpush", KEYS[1], ARGV[1])
+	end
+	if count == 0 then
+		redis.call("pexpire", KEYS[1], expiry)
+	end
+	return {1, 0, 0}
+end
+
+-- The current window is full, find the first upcoming window w/ room
+local start = chain
+if start == nil then
+	local ttl = redis.call("pttl", KEYS[1])
+	if ttl < 0 then
+		ttl = interval
+	end
+	start = now + ttl
+end
+
+while true do
+	local reserved = tonumber(redis.call("hget", KEYS[2], string.format("%d", start))) or 0
+	if reserved + n <= max then
+		break
+	end
+	start = start + interval
+end
+
+local delay = start - now
+if delay < 0 then
+	delay = 0
+end
+if wait >= 0 and delay > wait then
+	return {0, delay, 0}
+end
+
+redis.call("hincrby", KEYS[2], string.format("%d", start), n)
+if redis.call("pttl", KEYS[2]) < start + interval - now then
+	redis.call("pexpire", KEYS[2], start + interval - now)
+end
+return {1, delay, start}`)
+
+// fixedWindowCancelScript gives back room that was reserved in an upcoming window, as
+// long as the window hasn't begun yet. An emptied window is kept around so
+// that the upcoming windows stay anchored to it.
+//
+// KEYS[1] - the reservations hash
+// ARGV[1] - the start (in ms) of the reserved window
+// ARGV[2] - the amount of requests to give back
+// ARGV[3] - the current time (in ms)
+//
+// Returns 1 when the room was given back, otherwise 0
+var fixedWindowCancelScript = redis.NewScript(1, `
+if tonumber(ARGV[3]) >= tonumber(ARGV[1]) then
+	return 0
+end
+
+local left = redis.call("hincrby", KEYS[1], ARGV[1], -tonumber(ARGV[2]))
+if left < 0 then
+	redis.call("hset", KEYS[1], ARGV[1], 0)
+end
+return 1`)
+
+// slidingLogScript takes room for n requests in the limiter in a single step.
+//
+// Every admitted request is an entry in a sorted set, scored by the time (in
+// ms) it may proceed. Entries are dropped once they leave the rolling
+// interval. Entries scheduled ahead of time count against every request, so
+// no rolling interval ever holds more than the max, reservations included.
+//
+// KEYS[1] - the log sorted set
+// ARGV[1] - the id for the new entries
+// ARGV[2] - the max requests for a rolling interval
+// ARGV[3] - the time interval (in ms) of the rolling interval
+// ARGV[4] - the amount of requests to take room for
+// ARGV[5] - the current time (in ms)
+// ARGV[6] - the max time (in ms) to wait for room, or -1 for any
+//
+// Returns {1, delay, time of the entries} when room was taken, where the time
+// is 0 when there is no delay. Otherwise returns {0, delay until there is
+// room, 0}, with a delay of -1 when the request can never fit
+var slidingLogScript = redis.NewScript(1, `
+local max = tonumber(ARGV[2])
+local interval = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local now = tonumber(ARGV[5])
+local wait = tonumber(ARGV[6])
+
+if n > max then
+	return {0, -1, 0}
+end
+
+redis.call("zremrangebyscore", KEYS[1], "-inf", now - interval)
+
+-- When full, room opens up once the entry that puts us over the max leaves
+-- the rolling interval
+local at = now
+local count = redis.call("zcard", KEYS[1])
+if count + n > max then
+	local rank = count + n - max - 1
+	local entry = redis.call("zrange", KEYS[1], rank, rank, "withscores")
+	at = tonumber(entry[2]) + interval
+end
+
+local delay = at - now
+if wait >= 0 and delay > wait then
+	return {0, delay, 0}
+end
+
+for i = 1, n do
+	redis.call("zadd", KEYS[1], at, ARGV[1] .. ":" .. i)
+end
+
+-- Keep the log around until its last entry leaves the rolling interval
+local last = redis.call("zrange", KEYS[1], -1, -1, "withscores")
+redis.call("pexpire", KEYS[1], tonumber(last[2]) + interval - now)
+
+if delay == 0 then
+	return {1, 0, 0}
+end
+return {1, delay, at}`)
+
+// slidingLogCancelScript removes the entries that were scheduled ahead of
+// time, as long as their time hasn't come yet.
+//
+// KEYS[1] - the log sorted set
+// ARGV[1] - the id of the entries
+// ARGV[2] - the amount of entries
+// ARGV[3] - the time (in ms) of the entries
+// ARGV[4] - the current time (in ms)
+//
+// Returns 1 when the entries were removed, otherwise 0
+var slidingLogCancelScript = redis.NewScript(1, `
+if tonumber(ARGV[4]) >= tonumber(ARGV[3]) then
+	return 0
+end
+
+for i = 1, tonumber(ARGV[2]) do
+	redis.call("zrem", KEYS[1], ARGV[1] .. ":" .. i)
+end
+return 1`)
+
+// slidingLogRefundScript removes the entries of requests that were admitted,
+// as long as they are still in the rolling interval.
+//
+// KEYS[1] - the log sorted set
+// ARGV[1] - the id of the entries
+// ARGV[2] - the amount of entries
+// ARGV[3] - the time interval (in ms) of the rolling interval
+// ARGV[4] - the current time (in ms)
+//
+// Returns 1 when entries were removed, otherwise 0
+var slidingLogRefundScript = redis.NewScript(1, `
+local since = tonumber(ARGV[4]) - tonumber(ARGV[3])
+local removed = 0
+for i = 1, tonumber(ARGV[2]) do
+	local member = ARGV[1] .. ":" .. i
+	local at = tonumber(redis.call("zscore", KEYS[1], member))
+	if at ~= nil and at > since then
+		removed = removed + redis.call("zrem", KEYS[1], member)
+	end
+end
+
+if removed > 0 then
+	return 1
+end
+return 0`)
+
+// slidingCounterScript takes room for n requests in the limiter in a single
+// step.
+//
+// A hash holds a counter for each window, where windows are aligned to
+// multiples of the interval and only the current and previous counters are
+// kept. The previous counter is weighed by how much of the previous window
+// still overlaps the rolling interval, which assumes its requests were spread
+// evenly across it.
+//
+// KEYS[1] - the counters hash
+// ARGV[1] - the max requests for a rolling interval
+// ARGV[2] - the time interval (in ms) of a window
+// ARGV[3] - the amount of requests to take room for
+// ARGV[4] - the current time (in ms)
+//
+// Returns {1, 0, 0} when room was taken. Otherwise returns {0, delay until
+// there is room, 0}, with a delay of -1 when the request can never fit
+var slidingCounterScript = redis.NewScript(1, `
+local max = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+
+if n > max then
+	return {0, -1, 0}
+end
+
+local current = math.floor(now / interval)
+local elapsed = now - current * interval
+
+-- Only the current and previous counters are of interest
+local windows = redis.call("hkeys", KEYS[1])
+for i = 1, #windows do
+	if tonumber(windows[i]) < current - 1 then
+		redis.call("hdel", KEYS[1], windows[i])
+	end
+end
+
+local currentField = string.format("%d", current)
+local count = tonumber(redis.call("hget", KEYS[1], currentField)) or 0
+local previous = tonumber(redis.call("hget", KEYS[1], string.format("%d", current - 1))) or 0
+
+local weight = (interval - elapsed) / interval
+if previous * weight + count + n <= max then
+	redis.call("hincrby", KEYS[1], currentField, n)
+	redis.call("pexpire", KEYS[1], 2 * interval - elapsed)
+	return {1, 0, 0}
+end
+
+local delay
+if count + n <= max then
+	-- Wait for the weight of the previous window to fall far enough
+	local target = (max - count - n) / previous
+	delay = math.ceil(interval * (1 - target) - elapsed)
+else
+	-- Wait for the next window, where the current one becomes the previous
+	-- one, and for its weight to fall far enough
+	local target = (max - n) / count
+	delay = interval - elapsed + math.ceil(interval * (1 - target))
+end
+
+if delay < 1 then
+	delay = 1
+end
+return {0, delay, 0}`)
+
+// counterRefundScript gives back requests that were counted in the windows
+// of a SlidingWindowCounter, or of the rules of a composite limiter, as long
+// as the windows haven't rolled over.
+//
+// KEYS[1] - the counters hash
+// ARGV[1] - the time (in ms) the requests were counted at
+// ARGV[2] - the amount of requests to give back
+// ARGV[3] - the current time (in ms)
+// ARGV[4...] - the time interval (in ms) and the prefix of the counters of
+// each window, where the prefix is empty for a SlidingWindowCounter
+//
+// Returns 1 when requests were given back, otherwise 0
+var counterRefundScript = redis.NewScript(1, `
+local at = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local refunded = 0
+for i = 4, #ARGV, 2 do
+	local interval = tonumber(ARGV[i])
+	local window = math.floor(at / interval)
+	if window == math.floor(now / interval) then
+		local field = ARGV[i + 1] .. string.format("%d", window)
+		local count = tonumber(redis.call("hget", KEYS[1], field)) or 0
+		if count >= n then
+			redis.call("hincrby", KEYS[1], field, -n)
+			refunded = 1
+		end
+	end
+end
+return refunded`)
+
+// gcraScript takes room for n requests in the limiter in a single step.
+//
+// Only the theoretical arrival time (TAT) of the next request is stored. Each
+// request moves the TAT forward by the emission interval, and is allowed once
+// the TAT is no more than burst emission intervals ahead of the current time.
+//
+// KEYS[1] - the TAT key
+// ARGV[1] - the emission interval (in ms)
+// ARGV[2] - the max requests allowed at once
+// ARGV[3] - the amount of requests to take room for
+// ARGV[4] - the current time (in ms)
+// ARGV[5] - the max time (in ms) to wait for room, or -1 for any
+//
+// Returns {1, delay, time the requests are allowed at} when room was taken,
+// where the time is 0 when there is no delay. Otherwise returns {0, delay
+// until there is room, 0}, with a delay of -1 when the request can never fit
+var gcraScript = redis.NewScript(1, `
+local emission = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local wait = tonumber(ARGV[5])
+
+if n > burst then
+	return {0, -1, 0}
+end
+
+local tat = tonumber(redis.call("get", KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+
+local newTat = tat + n * emission
+local allowAt = newTat - burst * emission
+local delay = math.ceil(allowAt - now)
+if delay < 0 then
+	delay = 0
+end
+if wait >= 0 and delay > wait then
+	return {0, delay, 0}
+end
+
+-- The TAT is only of interest until it falls behind the current time
+redis.call("set", KEYS[1], string.format("%.3f", newTat), "px", math.ceil(newTat - now))
+
+if delay == 0 then
+	return {1, 0, 0}
+end
+return {1, delay, math.ceil(allowAt)}`)
+
+// gcraCancelScript moves the TAT back for requests that were allowed ahead of
+// time, as long as their time hasn't come yet.
+//
+// KEYS[1] - the TAT key
+// ARGV[1] - the emission interval (in ms)
+// ARGV[2] - the amount of requests to give back
+// ARGV[3] - the time (in ms) the requests were allowed at
+// ARGV[4] - the current time (in ms)
+//
+// Returns 1 when the room was given back, otherwise 0
+var gcraCancelScript = redis.NewScript(1, `
+local now = tonumber(ARGV[4])
+if now >= tonumber(ARGV[3]) then
+	return 0
+end
+
+local tat = tonumber(redis.call("get", KEYS[1]))
+if tat == nil then
+	return 0
+end
+
+tat = tat - tonumber(ARGV[2]) * tonumber(ARGV[1])
+if tat <= now then
+	redis.call("del", KEYS[1])
+else
+	redis.call("set", KEYS[1], string.format("%.3f", tat), "px", math.ceil(tat - now))
+end
+return 1`)
+
+// gcraRefundScript moves the TAT back for requests that were admitted, as
+// long as their room hasn't freed up. The room of a request frees up once
+// the TAT falls behind the current time, and at the latest a burst's worth
+// of emission intervals after it was taken, which is the window of a GCRA.
+//
+// KEYS[1] - the TAT key
+// ARGV[1] - the emission interval (in ms)
+// ARGV[2] - the max burst
+// ARGV[3] - the amount of requests to give back
+// ARGV[4] - the time (in ms) the requests were admitted at
+// ARGV[5] - the current time (in ms)
+//
+// Returns 1 when the room was given back, otherwise 0
+var gcraRefundScript = redis.NewScript(1, `
+local emission = tonumber(ARGV[1])
+local now = tonumber(ARGV[5])
+if now >= tonumber(ARGV[4]) + tonumber(ARGV[2]) * emission then
+	return 0
+end
+
+local tat = tonumber(redis.call("get", KEYS[1]))
+if tat == nil or tat <= now then
+	return 0
+end
+
+tat = tat - tonumber(ARGV[3]) * emission
+if tat <= now then
+	redis.call("del", KEYS[1])
+else
+	redis.call("set", KEYS[1], string.format("%.3f", tat), "px", math.ceil(tat - now))
+end
+return 1`)
+
+// leakyBucketScript hands out the next free slot for n requests in a single
+// step.
+//
+// Only the time of the next free slot is stored. Each request moves it
+// forward by the spacing, so that requests are spread evenly however many
+// processes are calling.
+//
+// KEYS[1] - the next slot key
+// ARGV[1] - the spacing (in ms) between slots
+// ARGV[2] - the amount of requests to take slots for
+// ARGV[3] - the current time (in ms)
+// ARGV[4] - the max time (in ms) to wait for the slot, or -1 for any
+//
+// Returns {1, delay, time of the slot} when the slot was taken, where the time
+// is 0 when there is no delay. Otherwise returns {0, delay until the slot, 0}
+var leakyBucketScript = redis.NewScript(1, `
+local spacing = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local wait = tonumber(ARGV[4])
+
+local slot = tonumber(redis.call("get", KEYS[1])) or now
+if slot < now then
+	slot = now
+end
+
+local delay = math.ceil(slot - now)
+if wait >= 0 and delay > wait then
+	return {0, delay, 0}
+end
+
+local nextSlot = slot + n * spacing
+redis.call("set", KEYS[1], string.format("%.3f", nextSlot), "px", math.ceil(nextSlot - now))
+
+if delay == 0 then
+	return {1, 0, 0}
+end
+return {1, delay, math.ceil(slot)}`)
+
+// leakyBucketCancelScript gives back slots that haven't come yet, as long as
+// no one has taken a slot after them. Giving back any other slot would hand
+// out a slot that overlaps one already taken.
+//
+// KEYS[1] - the next slot key
+// ARGV[1] - the spacing (in ms) between slots
+// ARGV[2] - the amount of requests the slots were taken for
+// ARGV[3] - the time (in ms) of the slot
+// ARGV[4] - the current time (in ms)
+//
+// Returns 1 when the slots were given back, otherwise 0
+var leakyBucketCancelScript = redis.NewScript(1, `
+local now = tonumber(ARGV[4])
+local slot = tonumber(ARGV[3])
+if now >= slot then
+	return 0
+end
+
+local nextSlot = tonumber(redis.call("get", KEYS[1]))
+if nextSlot == nil then
+	return 0
+end
+
+-- The slot time was rounded up to the ms
+local taken = nextSlot - tonumber(ARGV[2]) * tonumber(ARGV[1])
+if slot - taken < 0 or slot - taken >= 1 then
+	return 0
+end
+
+redis.call("set", KEYS[1], string.format("%.3f", taken), "px", math.ceil(taken - now))
+return 1`)
+
+// compositeScript takes room for n requests in every rule of a composite
+// limiter in a single step, or in none of them.
+//
+// Each rule is counted like the slidingCounterScript does, w/ the counters of
+// every rule kept in a single hash, keyed by "interval:window". The request is
+// only counted once every rule has room for it, so a rule that turns it down
+// doesn't cost the others any room.
+//
+// KEYS[1] - the counters hash
+// ARGV[1] - the amount of requests to take room for
+// ARGV[2] - the current time (in ms)
+// ARGV[3...] - the max requests and time interval (in ms) of each rule
+//
+// Returns {1, 0, 0} when room was taken. Otherwise returns {0, delay until
+// every rule has room, 0}, with a delay of -1 when the request can never fit
+var compositeScript = redis.NewScript(1, `
+local n = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+
+local rules = {}
+local current = {}
+for i = 3, #ARGV, 2 do
+	local max = tonumber(ARGV[i])
+	local interval = tonumber(ARGV[i + 1])
+	if n > max then
+		return {0, -1, 0}
+	end
+	rules[#rules + 1] = {max, interval}
+	current[interval] = math.floor(now / interval)
+end
+
+-- Only the current and previous counters of each rule are of interest
+local fields = redis.call("hkeys", KEYS[1])
+for i = 1, #fields do
+	local interval, window = string.match(fields[i], "^(%d+):(%d+)$")
+	local index = current[tonumber(interval)]
+	if index == nil or tonumber(window) < index - 1 then
+		redis.call("hdel", KEYS[1], fields[i])
+	end
+end
+
+local delay = 0
+local expiry = 0
+local increments = {}
+for i = 1, #rules do
+	local max, interval = rules[i][1], rules[i][2]
+	local window = current[interval]
+	local elapsed = now - window * interval
+
+	local currentField = string.format("%d:%d", interval, window)
+	local count = tonumber(redis.call("hget", KEYS[1], currentField)) or 0
+	local previous = tonumber(redis.call("hget", KEYS[1], string.format("%d:%d", interval, window - 1))) or 0
+
+	local weight = (interval - elapsed) / interval
+	if previous * weight + count + n > max then
+		local ruleDelay
+		if count + n <= max then
+			local target = (max - count - n) / previous
+			ruleDelay = math.ceil(interval * (1 - target) - elapsed)
+		else
+			local target = (max - n) / count
+			ruleDelay = interval - elapsed + math.ceil(interval * (1 - target))
+		end
+		if ruleDelay < 1 then
+			ruleDelay = 1
+		end
+		if ruleDelay > delay then
+			delay = ruleDelay
+		end
+	end
+
+	increments[#increments + 1] = currentField
+	if 2 * interval - elapsed > expiry then
+		expiry = 2 * interval - elapsed
+	end
+end
+
+if delay > 0 then
+	return {0, delay, 0}
+end
+
+for i = 1, #increments do
+	redis.call("hincrby", KEYS[1], increments[i], n)
+end
+redis.call("pexpire", KEYS[1], expiry)
+return {1, 0, 0}`)
+
+// acquireLeaseScript acquires a lease in a concurrency limiter in a single
+// step.
+//
+// The leases are a sorted set of their ids, scored by the time (in ms) they
+// expire at. Expired leases are dropped before counting, so a crashed holder
+// only keeps its slot until its lease runs out. The time is read from redis,
+// so that holders on hosts whose clocks drift apart agree on when a lease
+// expires. Since the script reads the time, its writes are replicated
+// rather than the script itself.
+//
+// KEYS[1] - the leases sorted set
+// ARGV[1] - the id of the lease
+// ARGV[2] - the max leases held at once
+// ARGV[3] - the TTL (in ms) of a lease
+//
+// Returns 1 when the lease was acquired, otherwise 0
+var acquireLeaseScript = redis.NewScript(1, `
+redis.replicate_commands()
+local time = redis.call("time")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local ttl = tonumber(ARGV[3])
+
+redis.call("zremrangebyscore", KEYS[1], "-inf", now)
+if redis.call("zcard", KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+
+redis.call("zadd", KEYS[1], now + ttl, ARGV[1])
+if redis.call("pttl", KEYS[1]) < ttl then
+	redis.call("pexpire", KEYS[1], ttl)
+end
+return 1`)
+
+// renewLeaseScript pushes back the expiry of a lease that is still held. The
+// time is read from redis, like the acquireLeaseScript does.
+//
+// KEYS[1] - the leases sorted set
+// ARGV[1] - the id of the lease
+// ARGV[2] - the TTL (in ms) of a lease
+//
+// Returns 1 when the lease was renewed, or 0 when it was lost
+var renewLeaseScript = redis.NewScript(1, `
+redis.replicate_commands()
+local time = redis.call("time")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local ttl = tonumber(ARGV[2])
+
+local expiry = tonumber(redis.call("zscore", KEYS[1], ARGV[1]))
+if expiry == nil or expiry <= now then
+	redis.call("zrem", KEYS[1], ARGV[1])
+	return 0
+end
+
+redis.call("zadd", KEYS[1], now + ttl, ARGV[1])
+if redis.call("pttl", KEYS[1]) < ttl then
+	redis.call("pexpire", KEYS[1], ttl)
+end
+return 1`)
+
+// countLeasesScript counts the leases that haven't expired, on the time of
+// redis like the acquireLeaseScript.
+//
+// KEYS[1] - the leases sorted set
+//
+// Returns the amount of leases held
+var countLeasesScript = redis.NewScript(1, `
+local time = redis.call("time")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+return redis.call("zcount", KEYS[1], "(" .. now, "+inf")`)
+
+// hierarchyScript takes room for n requests in a limiter and every limiter
+// it is nested within in a single step, or in none of them.
+//
+// Each level is counted like the compositeScript does, in the hash it uses
+// on its own. The counters of a composite level are keyed by
+// "interval:window", while those of a SlidingWindowCounter are keyed by the
+// window alone, so each rule comes w/ the prefix of its counters.
+//
+// KEYS[1...] - the counters hash of each level, starting w/ the limiter
+// ARGV[1] - the amount of requests to take room for
+// ARGV[2] - the current time (in ms)
+// ARGV[3...] - for each level, the amount of rules followed by the max
+// requests, time interval (in ms) and counter prefix of each rule
+//
+// Returns {1, 0, 0, 0} when room was taken. Otherwise returns {0, delay until
+// every level has room, 0, level}, w/ a delay of -1 when the request can never
+// fit, where the level is the index of the level that has room last, 0 being
+// the limiter itself
+var hierarchyScript = redis.NewScript(-1, `
+local n = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+
+local levels = {}
+local i = 3
+for level = 1, #KEYS do
+	local rules = {}
+	for r = 1, tonumber(ARGV[i]) do
+		rules[r] = {tonumber(ARGV[i + 1]), tonumber(ARGV[i + 2]), ARGV[i + 3]}
+		i = i + 3
+	end
+	levels[level] = rules
+	i = i + 1
+end
+
+local delay = 0
+local denied = 0
+local increments = {}
+local expiries = {}
+for level = 1, #KEYS do
+	local current = {}
+	for r = 1, #levels[level] do
+		local rule = levels[level][r]
+		if n > rule[1] then
+			return {0, -1, 0, level - 1}
+		end
+		current[rule[3]] = math.floor(now / rule[2])
+	end
+
+	-- Only the current and previous counters of each rule are of interest
+	local fields = redis.call("hkeys", KEYS[level])
+	for f = 1, #fields do
+		local prefix, window = string.match(fields[f], "^(.-)(%d+)$")
+		local index = current[prefix]
+		if index == nil or tonumber(window) < index - 1 then
+			redis.call("hdel", KEYS[level], fields[f])
+		end
+	end
+
+	expiries[level] = 0
+	for r = 1, #levels[level] do
+		local max, interval, prefix = levels[level][r][1], levels[level][r][2], levels[level][r][3]
+		local window = current[prefix]
+		local elapsed = now - window * interval
+
+		local currentField = prefix .. string.format("%d", window)
+		local count = tonumber(redis.call("hget", KEYS[level], currentField)) or 0
+		local previous = tonumber(redis.call("hget", KEYS[level], prefix .. string.format("%d", window - 1))) or 0
+
+		local weight = (interval - elapsed) / interval
+		if previous * weight + count + n > max then
+			local ruleDelay
+			if count + n <= max then
+				local target = (max - count - n) / previous
+				ruleDelay = math.ceil(interval * (1 - target) - elapsed)
+			else
+				local target = (max - n) / count
+				ruleDelay = interval - elapsed + math.ceil(interval * (1 - target))
+			end
+			if ruleDelay < 1 then
+				ruleDelay = 1
+			end
+			if ruleDelay > delay then
+				delay = ruleDelay
+				denied = level - 1
+			end
+		end
+
+		increments[#increments + 1] = {KEYS[level], currentField}
+		if 2 * interval - elapsed > expiries[level] then
+			expiries[level] = 2 * interval - elapsed
+		end
+	end
+end
+
+if delay > 0 then
+	return {0, delay, 0, denied}
+end
+
+for j = 1, #increments do
+	redis.call("hincrby", increments[j][1], increments[j][2], n)
+end
+for level = 1, #KEYS do
+	redis.call("pexpire", KEYS[level], expiries[level])
+end
+return {1, 0, 0, 0}`)
+
+// hierarchyRefundScript gives back requests that the hierarchyScript took in
+// a limiter and every limiter it is nested within, in a single step. The
+// limiters above are only given the requests back when the limiter itself
+// was, so that a refund that came too late doesn't free room in them.
+//
+// KEYS[1...] - the counters hash of each level, starting w/ the limiter
+// ARGV[1] - the time (in ms) the requests were counted at
+// ARGV[2] - the amount of requests to give back
+// ARGV[3] - the current time (in ms)
+// ARGV[4...] - for each level, the amount of rules followed by the time
+// interval (in ms) and counter prefix of each rule
+//
+// Returns 1 when requests were given back, otherwise 0
+var hierarchyRefundScript = redis.NewScript(-1, `
+local at = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local i = 4
+for level = 1, #KEYS do
+	local refunded = 0
+	for r = 1, tonumber(ARGV[i]) do
+		local interval = tonumber(ARGV[i + 2 * r - 1])
+		local window = math.floor(at / interval)
+		if window == math.floor(now / interval) then
+			local field = ARGV[i + 2 * r] .. string.format("%d", window)
+			local count = tonumber(redis.call("hget", KEYS[level], field)) or 0
+			if count >= n then
+				redis.call("hincrby", KEYS[level], field, -n)
+				refunded = 1
+			end
+		end
+	end
+	if level == 1 and refunded == 0 then
+		return 0
+	end
+	i = i + 1 + 2 * tonumber(ARGV[i])
+end
+return 1`)
+
+// queueEnqueueScript hands out the next ticket of the fair queue of a
+// limiter, and holds it for the ttl.
+//
+// The tickets waiting are kept in a sorted set scored by their number, so
+// that the first one is the one that arrived first, while the time each is
+// held until is kept in a hash. Both expire once no one is waiting.
+//
+// KEYS[1] - the ticket sequence
+// KEYS[2] - the queue sorted set
+// KEYS[3] - the leases hash
+// ARGV[1] - the current time (in ms)
+// ARGV[2] - the time (in ms) to hold the ticket for
+//
+// Returns the ticket
+var queueEnqueueScript = redis.NewScript(3, `
+local ttl = tonumber(ARGV[2])
+local ticket = redis.call("incr", KEYS[1])
+redis.call("zadd", KEYS[2], ticket, ticket)
+redis.call("hset", KEYS[3], ticket, tonumber(ARGV[1]) + ttl)
+redis.call("pexpire", KEYS[2], ttl)
+redis.call("pexpire", KEYS[3], ttl)
+return ticket`)
+
+// queueTurnScript renews a ticket of the fair queue of a limiter, and counts
+// the tickets ahead of it. The tickets that expired at the head of the queue
+// are dropped, so the waiters that crashed don't hold up the queue. A ticket
+// that expired while its waiter was still waiting takes back its place,
+// since it keeps its number.
+//
+// KEYS[1] - the queue sorted set
+// KEYS[2] - the leases hash
+// ARGV[1] - the ticket
+// ARGV[2] - the current time (in ms)
+// ARGV[3] - the time (in ms) to hold the ticket for
+//
+// Returns the amount of tickets ahead, which is 0 when it is the turn of the
+// ticket
+var queueTurnScript = redis.NewScript(2, `
+local now = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+redis.call("zadd", KEYS[1], ARGV[1], ARGV[1])
+redis.call("hset", KEYS[2], ARGV[1], now + ttl)
+redis.call("pexpire", KEYS[1], ttl)
+redis.call("pexpire", KEYS[2], ttl)
+
+while true do
+	local head = redis.call("zrange", KEYS[1], 0, 0)[1]
+	local expiry = tonumber(redis.call("hget", KEYS[2], head))
+	if expiry ~= nil and expiry > now then
+		return redis.call("zrank", KEYS[1], ARGV[1])
+	end
+	redis.call("zrem", KEYS[1], head)
+	redis.call("hdel", KEYS[2], head)
+end`)
+
+// queueWaitingScript counts the tickets waiting in the fair queue of a
+// limiter, once the tickets that expired at the head of the queue are
+// dropped.
+//
+// KEYS[1] - the queue sorted set
+// KEYS[2] - the leases hash
+// ARGV[1] - the current time (in ms)
+//
+// Returns the amount of tickets waiting
+var queueWaitingScript = redis.NewScript(2, `
+local now = tonumber(ARGV[1])
+while true do
+	local head = redis.call("zrange", KEYS[1], 0, 0)[1]
+	if head == nil then
+		return 0
+	end
+	local expiry = tonumber(redis.call("hget", KEYS[2], head))
+	if expiry ~= nil and expiry > now then
+		return redis.call("zcard", KEYS[1])
+	end
+	redis.call("zrem", KEYS[1], head)
+	redis.call("hdel", KEYS[2], head)
+end`)
+
+// queueLeaveScript removes a ticket from the fair queue of a limiter.
+//
+// KEYS[1] - the queue sorted set
+// KEYS[2] - the leases hash
+// ARGV[1] - the ticket
+var queueLeaveScript = redis.NewScript(2, `
+redis.call("zrem", KEYS[1], ARGV[1])
+redis.call("hdel", KEYS[2], ARGV[1])
+return 0`)
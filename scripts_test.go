@@ -0,0 +1,52 @@
+package funnel
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/meshhq/meshRedis"
+	. "gopkg.in/check.v1"
+)
+
+type ScriptsTest struct{}
+
+var _ = Suite(&ScriptsTest{})
+
+func (s *ScriptsTest) SetUpSuite(c *C) {
+	err := meshRedis.SetupRedis()
+	c.Assert(err, Equals, nil)
+}
+
+func (s *ScriptsTest) TearDownSuite(c *C) {
+	err := meshRedis.ClosePool()
+	c.Assert(err, Equals, nil)
+}
+
+// TestEvalScriptLoadsUnknownScripts tests that a script unknown to redis is
+// loaded and then run by its SHA
+func (s *ScriptsTest) TestEvalScriptLoadsUnknownScripts(c *C) {
+	conn := meshRedis.UnderlyingPool().Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SCRIPT", "FLUSH")
+	c.Assert(err, IsNil)
+
+	script := redis.NewScript(1, `return KEYS[1] .. ARGV[1]`)
+	reply, err := redis.String(evalScript(conn, script, "funnel", "Script"))
+	c.Assert(err, IsNil)
+	c.Assert(reply, Equals, "funnelScript")
+
+	// Now that it's loaded, it runs straight from the SHA
+	reply, err = redis.String(evalSHA(conn, script, "funnel", "Script"))
+	c.Assert(err, IsNil)
+	c.Assert(reply, Equals, "funnelScript")
+}
+
+// TestEvalScriptReturnsScriptErrors tests that errors raised by a script are
+// handed back to the caller
+func (s *ScriptsTest) TestEvalScriptReturnsScriptErrors(c *C) {
+	conn := meshRedis.UnderlyingPool().Get()
+	defer conn.Close()
+
+	script := redis.NewScript(0, `return redis.error_reply("funnel")`)
+	_, err := evalScript(conn, script)
+	c.Assert(err, ErrorMatches, ".*funnel.*")
+}
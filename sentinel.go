@@ -0,0 +1,180 @@
+package funnel
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// sentinelTimeout is the max time to wait on a sentinel
+const sentinelTimeout = time.Second
+
+// SentinelPool vends connections to the master of a redis deployment that is
+// monitored by sentinel. The master is looked up through the sentinels, and
+// looked up again when a command fails in a way that points to a failover,
+// such as a dropped connection or a READONLY reply from a demoted master
+type SentinelPool struct {
+	// sentinels are the addresses of the sentinels
+	sentinels []string
+
+	// masterName is the name the sentinels monitor the master under
+	masterName string
+
+	// dialOptions are used for every connection to the master
+	dialOptions []redis.DialOption
+
+	// mutex guards the master and pool
+	mutex sync.RWMutex
+
+	// master is the address of the current master
+	master string
+
+	// pool is the connection pool for the current master
+	pool *redis.Pool
+}
+
+// NewSentinelPool is a factory method for creating a pool for the master
+// that the sentinels monitor under masterName
+func NewSentinelPool(sentinels []string, masterName string, opts ...redis.DialOption) (*SentinelPool, error) {
+	if len(sentinels) == 0 {
+		return nil, errors.New("Unable to create the sentinel pool. At least one sentinel address is required")
+	}
+	if masterName == "" {
+		return nil, errors.New("Unable to create the sentinel pool. The master name is required")
+	}
+
+	pool := &SentinelPool{
+		sentinels:   sentinels,
+		masterName:  masterName,
+		dialOptions: opts,
+	}
+	if err := pool.refresh(); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// Get returns a connection to the current master
+func (p *SentinelPool) Get() redis.Conn {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.pool.Get()
+}
+
+// Master returns the address of the current master
+func (p *SentinelPool) Master() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.master
+}
+
+// Close closes the pool of the current master
+func (p *SentinelPool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pool.Close()
+}
+
+// refresh asks the sentinels for the address of the master, and switches
+// over to it when it changed
+func (p *SentinelPool) refresh() error {
+	master, err := p.lookupMaster()
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if master == p.master {
+		return nil
+	}
+
+	if p.pool != nil {
+		p.pool.Close()
+	}
+	p.master = master
+	p.pool = &redis.Pool{
+		MaxIdle: 3,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", master, p.dialOptions...)
+		},
+	}
+	return nil
+}
+
+// lookupMaster returns the address of the master from the first sentinel
+// that knows it
+func (p *SentinelPool) lookupMaster() (string, error) {
+	err := errors.New("Unable to find the master. No sentinel knows of " + p.masterName)
+	for _, sentinel := range p.sentinels {
+		conn, dialErr := redis.Dial("tcp", sentinel, redis.DialConnectTimeout(sentinelTimeout),
+			redis.DialReadTimeout(sentinelTimeout), redis.DialWriteTimeout(sentinelTimeout))
+		if dialErr != nil {
+			err = dialErr
+			continue
+		}
+
+		addr, replyErr := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", p.masterName))
+		conn.Close()
+		if replyErr == nil && len(addr) == 2 {
+			return net.JoinHostPort(addr[0], addr[1]), nil
+		}
+		if replyErr != nil && replyErr != redis.ErrNil {
+			err = replyErr
+		}
+	}
+	return "", err
+}
+
+// run runs f on a connection to the master. When f fails because of a
+// failover, the master is looked up again. f is only run once more when it
+// never reached the master, since the scripts of a limiter aren't safe to
+// run twice. A command that was lost w/ the connection fails, and the next
+// one goes to the new master
+func (p *SentinelPool) run(key string, f func(redis.Conn) (interface{}, error)) (interface{}, error) {
+	conn := p.Get()
+	reply, err := f(conn)
+	conn.Close()
+	if !isFailoverError(err) {
+		return reply, err
+	}
+
+	if refreshErr := p.refresh(); refreshErr != nil || !isUnsentError(err) {
+		return reply, err
+	}
+	conn = p.Get()
+	defer conn.Close()
+	return f(conn)
+}
+
+// isFailoverError reports whether err is caused by the master going away,
+// rather than by the command itself
+func isFailoverError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(redis.Error); ok {
+		return isUnsentError(err)
+	}
+	return true
+}
+
+// isUnsentError reports whether err proves that the command never ran on the
+// master: the connection couldn't be made, or a demoted master or a master
+// that lost its replicas turned the command down
+func isUnsentError(err error) bool {
+	if e, ok := err.(redis.Error); ok {
+		return strings.HasPrefix(string(e), "READONLY") || strings.HasPrefix(string(e), "MASTERDOWN")
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || err == redis.ErrPoolExhausted
+}
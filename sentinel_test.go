@@ -0,0 +1,107 @@
+package funnel
+
+import (
+	"errors"
+	"flag"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/garyburd/redigo/redis"
+	. "gopkg.in/check.v1"
+)
+
+// The sentinel tests run against local sentinels monitoring a master, when
+// their addresses are given. The failover test fails the master over
+var (
+	sentinels      = flag.String("sentinel", "", "Comma separated addresses of the sentinels to test against")
+	sentinelMaster = flag.String("sentinel-master", "mymaster", "Name of the master monitored by the sentinels")
+)
+
+type SentinelTest struct{}
+
+var _ = Suite(&SentinelTest{})
+
+// newTestSentinelPool creates a pool for the master under test, skipping the
+// test when there are no sentinels
+func newTestSentinelPool(c *C) *SentinelPool {
+	if *sentinels == "" {
+		c.Skip("-sentinel not provided")
+	}
+
+	pool, err := NewSentinelPool(strings.Split(*sentinels, ","), *sentinelMaster)
+	c.Assert(err, IsNil)
+	return pool
+}
+
+//---------
+// Test Setup
+//---------
+
+// TestSentinelPoolValidation tests that a sentinel pool needs sentinels and
+// the name of a master
+func (s *SentinelTest) TestSentinelPoolValidation(c *C) {
+	_, err := NewSentinelPool(nil, "mymaster")
+	c.Assert(err, NotNil)
+
+	_, err = NewSentinelPool([]string{"127.0.0.1:26379"}, "")
+	c.Assert(err, NotNil)
+}
+
+// TestIsFailoverError tests which errors send the pool looking for a new
+// master
+func (s *SentinelTest) TestIsFailoverError(c *C) {
+	c.Assert(isFailoverError(nil), Equals, false)
+	c.Assert(isFailoverError(redis.Error("NOSCRIPT No matching script")), Equals, false)
+	c.Assert(isFailoverError(redis.Error("READONLY You can't write against a read only replica.")), Equals, true)
+	c.Assert(isFailoverError(errors.New("EOF")), Equals, true)
+
+	// Only commands that never reached the master are run again
+	c.Assert(isUnsentError(redis.Error("READONLY You can't write against a read only replica.")), Equals, true)
+	c.Assert(isUnsentError(redis.Error("MASTERDOWN Link with MASTER is down")), Equals, true)
+	c.Assert(isUnsentError(errors.New("EOF")), Equals, false)
+	c.Assert(isUnsentError(redis.ErrPoolExhausted), Equals, true)
+
+	_, err := redis.Dial("tcp", "127.0.0.1:1")
+	c.Assert(isUnsentError(err), Equals, true)
+}
+
+//---------
+// Test Live Sentinels
+//---------
+
+// TestSentinelFailover tests that a limiter keeps working once its master is
+// failed over
+func (s *SentinelTest) TestSentinelFailover(c *C) {
+	pool := newTestSentinelPool(c)
+	defer pool.Close()
+
+	rateLimiter, err := NewLimiterWithPool(pool, &RateLimitInfo{
+		Token:        "sentinelToken",
+		MaxRequests:  100,
+		TimeInterval: 1000,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(rateLimiter.Enter(), IsNil)
+	master := pool.Master()
+
+	// Fail over and wait for the sentinels to agree on the new master
+	conn, err := redis.Dial("tcp", strings.Split(*sentinels, ",")[0])
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Do("SENTINEL", "failover", *sentinelMaster)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 300; i++ {
+		if addr, _ := pool.lookupMaster(); addr != master {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	admitted, err := rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+	c.Assert(pool.Master(), Not(Equals), master)
+}
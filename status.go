@@ -0,0 +1,167 @@
+package funnel
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+)
+
+// Snapshot is how much room a RateLimiter has left, as seen by its store, so
+// that every process sharing the store sees the same picture
+type Snapshot struct {
+	// Limit is the most requests the limiter admits in its window
+	Limit int
+
+	// Used is the amount of requests counted in the window
+	Used int
+
+	// Remaining is the amount of requests the window still admits
+	Remaining int
+
+	// WindowStart is the time the window began at. Rolling windows began an
+	// interval ago, while paced strategies report the current time
+	WindowStart time.Time
+
+	// ResetAt is the time the room that is used begins to free up. It is
+	// the current time when nothing is used
+	ResetAt time.Time
+}
+
+// Usage is how much of a limiter is used, as kept by a Store. All time is in
+// ms
+type Usage struct {
+	// Limit is the most requests the limiter admits in its window
+	Limit int
+
+	// Used is the amount of requests counted in the window
+	Used int
+
+	// WindowStart is the time the window began at
+	WindowStart int64
+
+	// ResetAt is the time the room that is used begins to free up
+	ResetAt int64
+}
+
+// Status reports how much room the limiter has left, w/out taking any of it
+func (r *RateLimiter) Status(ctx context.Context) (Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return Snapshot{}, err
+	}
+
+	usage, err := r.store.Status(r.limit(), r.now())
+	if err != nil {
+		return Snapshot{}, storeError(err)
+	}
+
+	remaining := usage.Limit - usage.Used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Snapshot{
+		Limit:       usage.Limit,
+		Used:        usage.Used,
+		Remaining:   remaining,
+		WindowStart: timeFromMilliseconds(usage.WindowStart),
+		ResetAt:     timeFromMilliseconds(usage.ResetAt),
+	}, nil
+}
+
+// timeFromMilliseconds returns the time of a unix time in milliseconds
+func timeFromMilliseconds(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+/**
+ * Usage of each strategy
+ *
+ * The stores read the state of the limiter, and leave the math to these
+ */
+
+// fixedWindowUsage is the usage of a FixedWindow w/ count requests, whose
+// list expires in ttl ms, or has no expiry when ttl is negative
+func fixedWindowUsage(limit *Limit, count int, ttl int64, now int64) Usage {
+	if count == 0 || ttl < 0 {
+		return Usage{Limit: limit.MaxRequests, WindowStart: now, ResetAt: now}
+	}
+	return Usage{
+		Limit:       limit.MaxRequests,
+		Used:        count,
+		WindowStart: now + ttl - limit.TimeInterval,
+		ResetAt:     now + ttl,
+	}
+}
+
+// slidingLogUsage is the usage of a SlidingLog w/ count entries in the
+// rolling interval, the oldest of which is at oldest
+func slidingLogUsage(limit *Limit, count int, oldest int64, now int64) Usage {
+	usage := Usage{Limit: limit.MaxRequests, Used: count, WindowStart: now - limit.TimeInterval, ResetAt: now}
+	if count > 0 {
+		usage.ResetAt = oldest + limit.TimeInterval
+	}
+	return usage
+}
+
+// slidingCounterUsage is the usage of a SlidingWindowCounter w/ the counters
+// of the current and previous windows
+func slidingCounterUsage(max int, interval int64, count int, previous int, now int64) Usage {
+	start := now / interval * interval
+	weight := float64(interval-(now-start)) / float64(interval)
+	usage := Usage{
+		Limit:       max,
+		Used:        int(math.Ceil(float64(previous)*weight)) + count,
+		WindowStart: start,
+		ResetAt:     now,
+	}
+	if usage.Used > 0 {
+		usage.ResetAt = start + interval
+	}
+	return usage
+}
+
+// gcraUsage is the usage of a GCRA limiter whose theoretical arrival time is
+// at tat. Each emission interval the TAT is ahead of now is a request used
+func gcraUsage(limit *Limit, tat float64, now int64) Usage {
+	usage := Usage{Limit: limit.Burst, WindowStart: now, ResetAt: now}
+	if tat > float64(now) {
+		usage.Used = int(math.Ceil((tat - float64(now)) / limit.EmissionInterval))
+		usage.ResetAt = int64(math.Ceil(tat))
+	}
+	if usage.Used > usage.Limit {
+		usage.Used = usage.Limit
+	}
+	return usage
+}
+
+// leakyBucketUsage is the usage of a LeakyBucket whose next free slot is at
+// nextSlot. Each slot between now and the next free one is a request used
+func leakyBucketUsage(limit *Limit, nextSlot float64, now int64) Usage {
+	usage := Usage{Limit: limit.MaxRequests, WindowStart: now, ResetAt: now}
+	if nextSlot > float64(now) {
+		usage.Used = int(math.Ceil((nextSlot - float64(now)) / limit.slotSpacing()))
+		usage.ResetAt = int64(math.Ceil(nextSlot))
+	}
+	return usage
+}
+
+// compositeUsage is the usage of the rule w/ the least room left. counter
+// returns the counter of a rule for the window of the given index
+func compositeUsage(rules []Rule, counter func(interval int64, window int64) int, now int64) Usage {
+	var tightest Usage
+	for i, rule := range rules {
+		interval := rule.interval()
+		window := now / interval
+		usage := slidingCounterUsage(rule.MaxRequests, interval, counter(interval, window), counter(interval, window-1), now)
+		if i == 0 || usage.Limit-usage.Used < tightest.Limit-tightest.Used {
+			tightest = usage
+		}
+	}
+	return tightest
+}
+
+// quorumUsage is the usage that a quorum of the nodes agree is at least used
+func quorumUsage(usages []Usage, quorum int) Usage {
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Used > usages[j].Used })
+	return usages[quorum-1]
+}
@@ -0,0 +1,142 @@
+package funnel
+
+import (
+	"context"
+	"time"
+)
+
+import (
+	"github.com/garyburd/redigo/redis"
+	. "gopkg.in/check.v1"
+)
+
+// StatusTest reads the status of limiters on redis, through its own pool,
+// and on a MemoryStore
+type StatusTest struct{}
+
+var _ = Suite(&StatusTest{})
+
+// statusStrategies are the strategies whose status is checked
+var statusStrategies = []Strategy{FixedWindow, SlidingLog, SlidingWindowCounter, GCRA, LeakyBucket}
+
+// clearStatusLimiter removes every key the limiter may have left in redis
+func clearStatusLimiter(c *C, pool *redis.Pool, limit *Limit) {
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", limit.rateLimiterToken(), limit.reservationsToken(), limit.slidingLogToken(),
+		limit.slidingCounterToken(), limit.gcraToken(), limit.leakyBucketToken(), limit.compositeToken())
+	c.Assert(err, IsNil)
+}
+
+// assertStatus takes 3 of the 5 requests of the limiter, and checks that
+// the status reports them w/out taking any room itself
+func assertStatus(c *C, rateLimiter *RateLimiter) {
+	status, err := rateLimiter.Status(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(status.Limit, Equals, 5)
+	c.Assert(status.Used, Equals, 0)
+	c.Assert(status.Remaining, Equals, 5)
+
+	beginTime := time.Now()
+	if rateLimiter.strategy == LeakyBucket {
+		reservation, err := rateLimiter.ReserveN(3)
+		c.Assert(err, IsNil)
+		c.Assert(reservation.OK(), Equals, true)
+	} else {
+		admitted, err := rateLimiter.TryEnterN(3)
+		c.Assert(err, IsNil)
+		c.Assert(admitted, Equals, true)
+	}
+
+	for i := 0; i < 2; i++ {
+		status, err = rateLimiter.Status(context.Background())
+		c.Assert(err, IsNil)
+		c.Assert(status.Used, Equals, 3, Commentf("%s", rateLimiter.strategy))
+		c.Assert(status.Remaining, Equals, 2)
+		c.Assert(status.ResetAt.After(beginTime), Equals, true)
+		c.Assert(status.ResetAt.Before(beginTime.Add(2*time.Second)), Equals, true)
+		c.Assert(status.WindowStart.After(status.ResetAt), Equals, false)
+	}
+}
+
+//---------
+// Test Status
+//---------
+
+// TestStatusOnRedis tests the status of each strategy on redis
+func (s *StatusTest) TestStatusOnRedis(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	for _, strategy := range statusStrategies {
+		rateLimiter, err := New("statusToken", 5, time.Second, WithStore(NewRedisStore(pool)), WithStrategy(strategy))
+		c.Assert(err, IsNil)
+		clearStatusLimiter(c, pool, rateLimiter.limit())
+		assertStatus(c, rateLimiter)
+	}
+}
+
+// TestStatusInMemory tests the status of each strategy on a MemoryStore
+func (s *StatusTest) TestStatusInMemory(c *C) {
+	for _, strategy := range statusStrategies {
+		rateLimiter, err := New("statusToken", 5, time.Second, WithStore(NewMemoryStore()), WithStrategy(strategy))
+		c.Assert(err, IsNil)
+		assertStatus(c, rateLimiter)
+	}
+}
+
+// TestStatusOfFixedWindow tests that the window of a FixedWindow is read
+// from the expiry of its list
+func (s *StatusTest) TestStatusOfFixedWindow(c *C) {
+	pool := newTestPool(0)
+	defer pool.Close()
+
+	rateLimiter := newPoolLimiter(c, pool, "statusWindowToken", 5)
+	c.Assert(rateLimiter.Enter(), IsNil)
+	time.Sleep(100 * time.Millisecond)
+
+	status, err := rateLimiter.Status(context.Background())
+	c.Assert(err, IsNil)
+	window := status.ResetAt.Sub(status.WindowStart)
+	c.Assert(window, Equals, time.Second)
+	c.Assert(time.Until(status.ResetAt) < 950*time.Millisecond, Equals, true)
+}
+
+// TestStatusOfCompositeLimiter tests that the rule w/ the least room left is
+// reported
+func (s *StatusTest) TestStatusOfCompositeLimiter(c *C) {
+	rateLimiter, err := NewCompositeLimiter("statusToken", []Rule{
+		{MaxRequests: 5, Interval: time.Second},
+		{MaxRequests: 4, Interval: time.Minute},
+	}, WithStore(NewMemoryStore()))
+	c.Assert(err, IsNil)
+
+	c.Assert(rateLimiter.EnterN(3), IsNil)
+	status, err := rateLimiter.Status(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(status.Limit, Equals, 4)
+	c.Assert(status.Remaining, Equals, 1)
+}
+
+// TestStatusOfQuorumStore tests that the usage a quorum of the nodes reached
+// is reported, even w/ a node down
+func (s *StatusTest) TestStatusOfQuorumStore(c *C) {
+	rateLimiter := newQuorumLimiter(c, "statusQuorumToken", 5, newTestPool(2), newTestPool(3), newDownPool())
+	c.Assert(rateLimiter.EnterN(2), IsNil)
+
+	status, err := rateLimiter.Status(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(status.Used, Equals, 2)
+	c.Assert(status.Remaining, Equals, 3)
+}
+
+// TestStatusWithCancelledContext tests that a done context reads nothing
+func (s *StatusTest) TestStatusWithCancelledContext(c *C) {
+	rateLimiter, err := New("statusToken", 5, time.Second, WithStore(NewMemoryStore()))
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = rateLimiter.Status(ctx)
+	c.Assert(err, Equals, context.Canceled)
+}
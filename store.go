@@ -0,0 +1,99 @@
+package funnel
+
+// Store keeps the state of rate limiters. Each call must take or give back
+// room atomically, so that a store can be shared by every limiter (and every
+// process) using the same token
+type Store interface {
+	// Take takes room for n requests in the limiter described by limit. A
+	// wait of 0 only considers the current window, while a negative wait
+	// accepts room in any upcoming window. All time is in ms
+	Take(limit *Limit, n int, now int64, wait int64) (TakeResult, error)
+
+	// Cancel gives back the room for n requests that a previous Take
+	// reserved at window, as long as the window hasn't begun. It reports
+	// whether the room was given back
+	Cancel(limit *Limit, window int64, id string, n int, now int64) (bool, error)
+
+	// Refund gives back the room for n requests that a previous Take took
+	// at the time at, as long as the window it was taken in hasn't rolled
+	// over. It reports whether the room was given back
+	Refund(limit *Limit, at int64, id string, n int, now int64) (bool, error)
+
+	// Status reports how much of the limiter described by limit is used,
+	// w/out taking any room
+	Status(limit *Limit, now int64) (Usage, error)
+}
+
+// Limit describes the limiter whose state is kept in a Store
+type Limit struct {
+	// Token is the unique token the state is kept under
+	Token string
+
+	// Strategy is the algorithm used to count the requests
+	Strategy Strategy
+
+	// MaxRequests is the maximum amount of requests for the TimeInterval
+	MaxRequests int
+
+	// TimeInterval is the time (in ms) the max requests can take place inside
+	// of
+	TimeInterval int64
+
+	// EmissionInterval is the time (in ms) between requests at the sustained
+	// rate of the GCRA strategy
+	EmissionInterval float64
+
+	// Burst is the max amount of requests admitted at once by the GCRA
+	// strategy
+	Burst int
+
+	// KeyPrefix goes ahead of every key the state is kept under
+	KeyPrefix string
+
+	// LockExpiry is the time (in ms) a lock on the limiter is held for at
+	// most, for stores that take one. Zero means the store's default
+	LockExpiry int64
+
+	// Rules are the limits of a composite limiter. When there are any, room
+	// is taken in every rule or none of them, each counted like the
+	// SlidingWindowCounter strategy, and MaxRequests and TimeInterval are
+	// ignored
+	Rules []Rule
+
+	// Parent is the limit the limiter is nested within, if any. Room is
+	// taken in the limit and every limit above it, or none of them
+	Parent *Limit
+}
+
+// TakeResult is the outcome of an attempt to take room in a Store
+type TakeResult struct {
+	// Admitted is whether room was taken
+	Admitted bool
+
+	// Delay is the time (in ms) until the room can be used when admitted,
+	// or until there is room when not. It is -1 when the request can never
+	// fit
+	Delay int64
+
+	// Window is the time (in ms) the room was reserved at in an upcoming
+	// window, or 0 for the current window
+	Window int64
+
+	// ID identifies the entries that were taken, when the strategy tracks
+	// them individually
+	ID string
+
+	// Level is how many parents up the limit that held the request back is,
+	// when not admitted. It is 0 for the limit itself
+	Level int
+
+	// Degraded is whether the room was taken under the failure policy of the
+	// limiter, rather than in its store. Stores leave it unset
+	Degraded bool
+}
+
+// slotSpacing returns the time (in ms) between the slots of the LeakyBucket
+// strategy
+func (l *Limit) slotSpacing() float64 {
+	return float64(l.TimeInterval) / float64(l.MaxRequests)
+}
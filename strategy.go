@@ -0,0 +1,126 @@
+package funnel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Strategy is the algorithm a RateLimiter uses to count requests
+type Strategy int
+
+const (
+	// FixedWindow counts requests in a window that begins w/ the first
+	// request and lasts for the TimeInterval. Up to twice the MaxRequests
+	// can be admitted across the boundary of two windows
+	FixedWindow Strategy = iota
+
+	// SlidingLog keeps a log of the time of every admitted request, so that
+	// no rolling TimeInterval ever sees more than MaxRequests admissions.
+	// It costs one sorted set entry per request in the TimeInterval
+	SlidingLog
+
+	// SlidingWindowCounter keeps a counter for the current and previous
+	// windows, aligned to multiples of the TimeInterval, and weighs the
+	// previous counter by how much of it still overlaps the rolling
+	// TimeInterval. It is close to SlidingLog in accuracy, but costs the
+	// same small amount of memory however high the MaxRequests. It does
+	// not support reservations
+	SlidingWindowCounter
+
+	// GCRA is the generic cell rate algorithm. Requests are let through at
+	// a steady Rate, w/ up to Burst of them at once after a quiet period.
+	// Only the theoretical arrival time of the next request is stored
+	GCRA
+
+	// LeakyBucket paces requests evenly, TimeInterval / MaxRequests apart,
+	// across every process. Enter hands each caller a distinct slot and
+	// sleeps exactly until it, rather than retrying. Only the next free
+	// slot is stored
+	LeakyBucket
+)
+
+// String returns the name of the strategy
+func (s Strategy) String() string {
+	switch s {
+	case FixedWindow:
+		return "FixedWindow"
+	case SlidingLog:
+		return "SlidingLog"
+	case SlidingWindowCounter:
+		return "SlidingWindowCounter"
+	case GCRA:
+		return "GCRA"
+	case LeakyBucket:
+		return "LeakyBucket"
+	}
+	return "Unknown"
+}
+
+// valid reports whether s is a known strategy
+func (s Strategy) valid() bool {
+	return s >= FixedWindow && s <= LeakyBucket
+}
+
+// reservable reports whether room can be reserved ahead of time w/ s
+func (s Strategy) reservable() bool {
+	return s != SlidingWindowCounter
+}
+
+// tracksEntries reports whether each take of s has entries of its own, which
+// need an id so that they can be told apart from the entries of other takes
+func (s Strategy) tracksEntries() bool {
+	return s == FixedWindow || s == SlidingLog
+}
+
+/**
+ * Taking Room
+ */
+
+// takeAt takes room for n requests in the limiter's store at the given time
+// (in ms). A wait of 0 only considers the current window, while a negative
+// wait accepts room in any upcoming window. When the store is unavailable,
+// the failure policy decides
+func (r *RateLimiter) takeAt(n int, wait int64, now int64) (TakeResult, error) {
+	if r.degraded(now) {
+		return r.takeDegraded(n, now, wait)
+	}
+
+	result, err := r.store.Take(r.limit(), n, now, wait)
+	if err != nil {
+		if r.failurePolicy != FailOpen && r.failurePolicy != FailLocal {
+			return TakeResult{}, storeError(err)
+		}
+		r.setMode(ModeDegraded, now)
+		return r.takeDegraded(n, now, wait)
+	}
+	r.setMode(ModeNormal, now)
+
+	// A negative delay means the request can never fit
+	if result.Delay < 0 {
+		result.Delay = 0
+	}
+	return result, nil
+}
+
+// cancel gives back the room for n requests that was reserved at window
+// by a previous take, as long as the window hasn't begun. It reports
+// whether the room was given back
+func (r *RateLimiter) cancel(window int64, id string, n int) (bool, error) {
+	cancelled, err := r.store.Cancel(r.limit(), window, id, n, r.now())
+	return cancelled, storeError(err)
+}
+
+// refund gives back the room for n requests that a previous take admitted
+// at the given time, as long as its window hasn't rolled over. It reports
+// whether the room was given back
+func (r *RateLimiter) refund(at int64, id string, n int) (bool, error) {
+	refunded, err := r.store.Refund(r.limit(), at, id, n, r.now())
+	return refunded, storeError(err)
+}
+
+// newEntryID returns a random id for the entries of a take
+func newEntryID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
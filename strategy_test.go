@@ -0,0 +1,416 @@
+package funnel
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/meshhq/meshRedis"
+	. "gopkg.in/check.v1"
+)
+
+type StrategyTest struct{}
+
+var _ = Suite(&StrategyTest{})
+
+func (s *StrategyTest) SetUpSuite(c *C) {
+	err := meshRedis.SetupRedis()
+	c.Assert(err, Equals, nil)
+}
+
+func (s *StrategyTest) TearDownSuite(c *C) {
+	err := meshRedis.ClosePool()
+	c.Assert(err, Equals, nil)
+}
+
+// newStrategyLimiter creates a cleared limiter w/ the strategy
+func newStrategyLimiter(c *C, token string, strategy Strategy, max int, interval int64) *RateLimiter {
+	limiterInfo := &RateLimitInfo{
+		Token:        token,
+		MaxRequests:  max,
+		TimeInterval: interval,
+		Strategy:     strategy,
+	}
+
+	rateLimiter, err := NewLimiter(limiterInfo)
+	c.Assert(err, IsNil)
+
+	session := meshRedis.NewSession()
+	defer session.CloseSession()
+	c.Assert(session.Delete(rateLimiter.limit().rateLimiterToken()), IsNil)
+	c.Assert(session.Delete(rateLimiter.limit().reservationsToken()), IsNil)
+	c.Assert(session.Delete(rateLimiter.limit().slidingLogToken()), IsNil)
+	c.Assert(session.Delete(rateLimiter.limit().slidingCounterToken()), IsNil)
+	return rateLimiter
+}
+
+// TestUnknownStrategy tests that a limiter can't be created w/ a strategy
+// that doesn't exist
+func (s *StrategyTest) TestUnknownStrategy(c *C) {
+	limiterInfo := &RateLimitInfo{
+		Token:        "unknownStrategyToken",
+		MaxRequests:  5,
+		TimeInterval: 1000,
+		Strategy:     Strategy(-1),
+	}
+
+	_, err := NewLimiter(limiterInfo)
+	c.Assert(err, NotNil)
+}
+
+//---------
+// Test Sliding Log
+//---------
+
+// TestSlidingLogAcrossWindowBoundary tests that the sliding log doesn't allow
+// a burst across the boundary of two fixed windows
+func (s *StrategyTest) TestSlidingLogAcrossWindowBoundary(c *C) {
+	rateLimiter := newStrategyLimiter(c, "slidingLogBoundaryToken", SlidingLog, 5, 1000)
+
+	c.Assert(rateLimiter.Enter(), IsNil)
+	time.Sleep(700 * time.Millisecond)
+	c.Assert(rateLimiter.EnterN(4), IsNil)
+
+	// A fixed window would have reset by now, but the last four entries
+	// are still in the rolling interval
+	time.Sleep(400 * time.Millisecond)
+	admitted, err := rateLimiter.TryEnterN(2)
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+
+	admitted, reset, err := rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+	c.Assert(reset, Equals, time.Duration(0))
+
+	// Room opens up once the four entries leave the rolling interval
+	admitted, reset, err = rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(reset > 500*time.Millisecond, Equals, true)
+	c.Assert(reset <= 600*time.Millisecond, Equals, true)
+}
+
+// TestSlidingLogNeverExceedsMax tests that no rolling interval sees more than
+// the max admissions
+func (s *StrategyTest) TestSlidingLogNeverExceedsMax(c *C) {
+	rateLimiter := newStrategyLimiter(c, "slidingLogMaxToken", SlidingLog, 10, 500)
+
+	var admissions []int64
+	beginTime := unixInMilliseconds()
+	for unixInMilliseconds()-beginTime < 1500 {
+		attemptTime := unixInMilliseconds()
+		admitted, err := rateLimiter.TryEnter()
+		c.Assert(err, IsNil)
+		if admitted {
+			admissions = append(admissions, attemptTime)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Leave a little slack for the time between the attempt and the script
+	for i := range admissions {
+		inInterval := 0
+		for j := i; j < len(admissions) && admissions[j]-admissions[i] < 490; j++ {
+			inInterval++
+		}
+		c.Assert(inInterval <= 10, Equals, true)
+	}
+	c.Assert(len(admissions) >= 20, Equals, true)
+}
+
+// TestSlidingLogReservations tests that entries can be reserved ahead of time
+// and cancelled before their time comes
+func (s *StrategyTest) TestSlidingLogReservations(c *C) {
+	rateLimiter := newStrategyLimiter(c, "slidingLogReserveToken", SlidingLog, 2, 1000)
+
+	c.Assert(rateLimiter.EnterN(2), IsNil)
+
+	reservation, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(reservation.OK(), Equals, true)
+	c.Assert(reservation.Delay() > 900*time.Millisecond, Equals, true)
+
+	// The next reservation waits on the second entry, which came in at the
+	// same time
+	second, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(second.Delay() > 900*time.Millisecond, Equals, true)
+
+	// With both reserved, the next one has to wait on the reservations
+	third, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(third.Delay() > 1900*time.Millisecond, Equals, true)
+	c.Assert(third.Cancel(), IsNil)
+
+	// Giving one back makes room for a replacement in its place
+	c.Assert(second.Cancel(), IsNil)
+	replacement, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(replacement.Delay() < 1000*time.Millisecond, Equals, true)
+}
+
+//---------
+// Test Sliding Window Counter
+//---------
+
+// sleepUntilNextWindow sleeps until the given amount of ms have elapsed in
+// the next window aligned to the interval
+func sleepUntilNextWindow(elapsed int64, interval int64) {
+	now := unixInMilliseconds()
+	wait := interval - now%interval + elapsed
+	time.Sleep(time.Duration(wait) * time.Millisecond)
+}
+
+// TestSlidingCounterWeighsPreviousWindow tests that the requests of the
+// previous window count by how much of it overlaps the rolling interval
+func (s *StrategyTest) TestSlidingCounterWeighsPreviousWindow(c *C) {
+	rateLimiter := newStrategyLimiter(c, "slidingCounterWeightToken", SlidingWindowCounter, 10, 1000)
+
+	sleepUntilNextWindow(50, 1000)
+	c.Assert(rateLimiter.EnterN(10), IsNil)
+
+	admitted, reset, err := rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(reset > 900*time.Millisecond, Equals, true)
+
+	// 60% into the next window, the previous window counts for 4
+	sleepUntilNextWindow(600, 1000)
+	admitted, err = rateLimiter.TryEnterN(5)
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+
+	admitted, reset, err = rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+
+	admitted, reset, err = rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(reset > 0, Equals, true)
+	c.Assert(reset <= 300*time.Millisecond, Equals, true)
+}
+
+// TestSlidingCounterKeepsTwoCounters tests that only the current and previous
+// counters are kept, however many requests are made
+func (s *StrategyTest) TestSlidingCounterKeepsTwoCounters(c *C) {
+	rateLimiter := newStrategyLimiter(c, "slidingCounterMemoryToken", SlidingWindowCounter, 1000, 100)
+
+	beginTime := unixInMilliseconds()
+	for unixInMilliseconds()-beginTime < 500 {
+		_, err := rateLimiter.TryEnterN(10)
+		c.Assert(err, IsNil)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	conn := meshRedis.UnderlyingPool().Get()
+	defer conn.Close()
+	count, err := conn.Do("HLEN", rateLimiter.limit().slidingCounterToken())
+	c.Assert(err, IsNil)
+	c.Assert(count.(int64) <= 2, Equals, true)
+}
+
+// TestSlidingCounterReservations tests that reserving isn't possible w/ the
+// sliding window counter
+func (s *StrategyTest) TestSlidingCounterReservations(c *C) {
+	rateLimiter := newStrategyLimiter(c, "slidingCounterReserveToken", SlidingWindowCounter, 10, 1000)
+
+	_, err := rateLimiter.Reserve()
+	c.Assert(err, ErrorMatches, ".*SlidingWindowCounter.*")
+}
+
+//---------
+// Test GCRA
+//---------
+
+// newGCRALimiter creates a cleared GCRA limiter
+func newGCRALimiter(c *C, token string, rate float64, burst int) *RateLimiter {
+	limiterInfo := &RateLimitInfo{
+		Token:    token,
+		Strategy: GCRA,
+		Rate:     rate,
+		Burst:    burst,
+	}
+
+	rateLimiter, err := NewLimiter(limiterInfo)
+	c.Assert(err, IsNil)
+
+	session := meshRedis.NewSession()
+	defer session.CloseSession()
+	c.Assert(session.Delete(rateLimiter.limit().gcraToken()), IsNil)
+	return rateLimiter
+}
+
+// TestGCRABurstThenSteadyRate tests that GCRA admits a burst at once, and
+// then lets requests through at the sustained rate
+func (s *StrategyTest) TestGCRABurstThenSteadyRate(c *C) {
+	rateLimiter := newGCRALimiter(c, "gcraBurstToken", 10, 5)
+
+	for i := 0; i < 5; i++ {
+		admitted, err := rateLimiter.TryEnter()
+		c.Assert(err, IsNil)
+		c.Assert(admitted, Equals, true)
+	}
+
+	admitted, reset, err := rateLimiter.TryEnterWithReset()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, false)
+	c.Assert(reset > 0, Equals, true)
+	c.Assert(reset <= 100*time.Millisecond, Equals, true)
+
+	// The next five are spaced out by 100ms
+	beginTime := unixInMilliseconds()
+	for i := 0; i < 5; i++ {
+		c.Assert(rateLimiter.Enter(), IsNil)
+	}
+	totalTime := unixInMilliseconds() - beginTime
+	c.Assert(totalTime >= 400, Equals, true)
+	c.Assert(totalTime < 1500, Equals, true)
+
+	// Requests costing more than the burst can never fit
+	err = rateLimiter.EnterN(6)
+	c.Assert(err, NotNil)
+}
+
+// TestGCRADefaultsToMaxRequests tests that the rate and burst come from the
+// MaxRequests and TimeInterval when they aren't set
+func (s *StrategyTest) TestGCRADefaultsToMaxRequests(c *C) {
+	limiterInfo := &RateLimitInfo{
+		Token:        "gcraDefaultsToken",
+		MaxRequests:  20,
+		TimeInterval: 2000,
+		Strategy:     GCRA,
+	}
+
+	rateLimiter, err := NewLimiter(limiterInfo)
+	c.Assert(err, IsNil)
+	c.Assert(rateLimiter.burst, Equals, 20)
+	c.Assert(rateLimiter.emissionInterval, Equals, 100.0)
+
+	limiterInfo = &RateLimitInfo{
+		Token:    "gcraInvalidToken",
+		Strategy: GCRA,
+		Burst:    5,
+	}
+	_, err = NewLimiter(limiterInfo)
+	c.Assert(err, NotNil)
+}
+
+// TestGCRAReservations tests that reservations move the theoretical arrival
+// time, and that cancelling moves it back
+func (s *StrategyTest) TestGCRAReservations(c *C) {
+	rateLimiter := newGCRALimiter(c, "gcraReserveToken", 10, 1)
+
+	admitted, err := rateLimiter.TryEnter()
+	c.Assert(err, IsNil)
+	c.Assert(admitted, Equals, true)
+
+	first, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(first.OK(), Equals, true)
+	c.Assert(first.Delay() > 50*time.Millisecond, Equals, true)
+	c.Assert(first.Delay() <= 100*time.Millisecond, Equals, true)
+
+	second, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(second.Delay() > 150*time.Millisecond, Equals, true)
+	c.Assert(second.Cancel(), IsNil)
+
+	// The cancelled spot is handed out again
+	replacement, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(replacement.Delay() > 150*time.Millisecond, Equals, true)
+	c.Assert(replacement.Delay() <= 200*time.Millisecond, Equals, true)
+}
+
+//---------
+// Test Leaky Bucket
+//---------
+
+// TestLeakyBucketSpacesRequestsEvenly tests that concurrent callers are let
+// through one at a time, evenly spaced across the interval
+func (s *StrategyTest) TestLeakyBucketSpacesRequestsEvenly(c *C) {
+	rateLimiter := newStrategyLimiter(c, "leakyBucketToken", LeakyBucket, 20, 1000)
+
+	session := meshRedis.NewSession()
+	c.Assert(session.Delete(rateLimiter.limit().leakyBucketToken()), IsNil)
+	session.CloseSession()
+
+	var mutex sync.Mutex
+	var entries []int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Assert(rateLimiter.Enter(), IsNil)
+			mutex.Lock()
+			entries = append(entries, unixInMilliseconds())
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i] < entries[j] })
+	for i := 1; i < len(entries); i++ {
+		spacing := entries[i] - entries[i-1]
+		c.Assert(spacing >= 40, Equals, true)
+		c.Assert(spacing <= 60, Equals, true)
+	}
+}
+
+// TestLeakyBucketGivesBackAbandonedSlot tests that a caller who gives up on
+// the last slot hands it back for the next caller
+func (s *StrategyTest) TestLeakyBucketGivesBackAbandonedSlot(c *C) {
+	rateLimiter := newStrategyLimiter(c, "leakyBucketCancelToken", LeakyBucket, 5, 1000)
+
+	session := meshRedis.NewSession()
+	c.Assert(session.Delete(rateLimiter.limit().leakyBucketToken()), IsNil)
+	session.CloseSession()
+
+	c.Assert(rateLimiter.Enter(), IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := rateLimiter.EnterContext(ctx)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	// The abandoned slot is the next one handed out
+	reservation, err := rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(reservation.Delay() <= 150*time.Millisecond, Equals, true)
+}
+
+// TestLeakyBucketBoundsTheWait tests that a caller whose slot is further
+// ahead than the max wait is turned down right away, w/out taking the slot
+func (s *StrategyTest) TestLeakyBucketBoundsTheWait(c *C) {
+	rateLimiter, err := New("leakyBucketMaxWaitToken", 5, time.Second, WithStore(NewMemoryStore()),
+		WithStrategy(LeakyBucket), WithMaxWait(300*time.Millisecond))
+	c.Assert(err, IsNil)
+
+	// Slots are 200ms apart, so the next free one is 400ms ahead
+	reservation, err := rateLimiter.ReserveN(2)
+	c.Assert(err, IsNil)
+	c.Assert(reservation.OK(), Equals, true)
+
+	beginTime := time.Now()
+	err = rateLimiter.EnterN(2)
+	var limitErr *LimitError
+	c.Assert(errors.As(err, &limitErr), Equals, true)
+	c.Assert(limitErr.RetryAfter > 300*time.Millisecond, Equals, true)
+	c.Assert(time.Since(beginTime) < 100*time.Millisecond, Equals, true)
+
+	// The slot wasn't taken, so the next free one is still 400ms ahead
+	reservation, err = rateLimiter.Reserve()
+	c.Assert(err, IsNil)
+	c.Assert(reservation.Delay() > 300*time.Millisecond, Equals, true)
+	c.Assert(reservation.Delay() <= 400*time.Millisecond, Equals, true)
+
+	_, err = New("leakyBucketMaxWaitToken", 5, time.Second, WithStore(NewMemoryStore()), WithMaxWait(0))
+	c.Assert(err, ErrorMatches, ".*max wait must be at least 1ms.*")
+}